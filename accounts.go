@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Name of the account used when the config does not list any
+const defaultAccount = "default"
+
+// A twitch account twicciand can log in as, with its own tokens and api client
+type Account struct {
+	Name   string
+	Auth   *TwitchAuth
+	Api    *TwitchApi
+	Store  CredentialStore
+	Limits *ChatLimits // Twitch counts messages and joins per account
+}
+
+// What accounts.list reports about an account
+type AccountInfo struct {
+	Name          string `json:"name"`
+	Username      string `json:"username,omitempty"`
+	Active        bool   `json:"active"`
+	Authenticated bool   `json:"authenticated"`
+}
+
+// The accounts from the config, one of which chat and the api use by default
+type Accounts struct {
+	accounts map[string]*Account
+	names    []string // In the order they were added
+	active   string
+	lock     sync.Mutex
+
+	OnSwitch func(account *Account) // Called after another account became the active one
+}
+
+func NewAccounts() *Accounts {
+	accounts := new(Accounts)
+	accounts.accounts = make(map[string]*Account)
+	return accounts
+}
+
+// Create an account with its own auth object, api client and chat rate limits
+func NewAccount(name string) *Account {
+	account := new(Account)
+	account.Name = name
+	account.Auth = new(TwitchAuth)
+	account.Api = NewTwitchApi(account.Auth)
+	account.Limits = NewChatLimits()
+	return account
+}
+
+// Parse the comma separated account names of the config
+func parseAccountNames(value string) []string {
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		names = append(names, defaultAccount)
+	}
+	return names
+}
+
+// Add an account, the first one added becomes the active one
+func (accounts *Accounts) Add(account *Account) {
+	accounts.lock.Lock()
+	defer accounts.lock.Unlock()
+	if _, ok := accounts.accounts[account.Name]; !ok {
+		accounts.names = append(accounts.names, account.Name)
+	}
+	accounts.accounts[account.Name] = account
+	if accounts.active == "" {
+		accounts.active = account.Name
+	}
+}
+
+// Find an account by name, an empty name means the active account
+func (accounts *Accounts) Get(name string) *Account {
+	accounts.lock.Lock()
+	defer accounts.lock.Unlock()
+	if name == "" {
+		name = accounts.active
+	}
+	return accounts.accounts[strings.ToLower(name)]
+}
+
+// The account used when a call does not name one
+func (accounts *Accounts) Active() *Account {
+	return accounts.Get("")
+}
+
+// Names of every account, in the order of the config
+func (accounts *Accounts) Names() []string {
+	accounts.lock.Lock()
+	defer accounts.lock.Unlock()
+	return append([]string(nil), accounts.names...)
+}
+
+// Make another account the active one
+func (accounts *Accounts) Switch(name string) error {
+	accounts.lock.Lock()
+	account, ok := accounts.accounts[strings.ToLower(name)]
+	if !ok {
+		accounts.lock.Unlock()
+		return fmt.Errorf("Unknown account: %s", name)
+	}
+	changed := accounts.active != account.Name
+	accounts.active = account.Name
+	accounts.lock.Unlock()
+
+	if changed && accounts.OnSwitch != nil {
+		accounts.OnSwitch(account)
+	}
+	return nil
+}
+
+// Describe every account, for clients offering to switch between them
+func (accounts *Accounts) List() []AccountInfo {
+	active := accounts.Active()
+	list := []AccountInfo{}
+	for _, name := range accounts.Names() {
+		account := accounts.Get(name)
+		list = append(list, AccountInfo{
+			Name:          account.Name,
+			Username:      account.Auth.User(),
+			Active:        account == active,
+			Authenticated: account.Auth.Token() != "",
+		})
+	}
+	return list
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAccounts(t *testing.T) {
+	Convey("Test keeping several twitch accounts", t, func() {
+		accounts := NewAccounts()
+		owner := NewAccount("main")
+		bot := NewAccount("bot")
+		bot.Auth.Username = "some_bot"
+		accounts.Add(owner)
+		accounts.Add(bot)
+
+		Convey("Account names come from a comma separated list", func() {
+			So(parseAccountNames(" Main, bot,,main"), ShouldResemble, []string{"main", "bot"})
+			So(parseAccountNames(""), ShouldResemble, []string{defaultAccount})
+		})
+		Convey("The first account is active until switching", func() {
+			So(accounts.Active(), ShouldEqual, owner)
+			So(accounts.Get("BOT"), ShouldEqual, bot)
+
+			var switched *Account
+			accounts.OnSwitch = func(account *Account) {
+				switched = account
+			}
+			So(accounts.Switch("bot"), ShouldBeNil)
+			So(switched, ShouldEqual, bot)
+			So(accounts.Get(""), ShouldEqual, bot)
+			So(accounts.Switch("nobody"), ShouldNotBeNil)
+
+			list := accounts.List()
+			So(list, ShouldHaveLength, 2)
+			So(list[1], ShouldResemble, AccountInfo{Name: "bot", Username: "some_bot", Active: true})
+		})
+		Convey("Each account is rate limited on its own", func() {
+			So(owner.Limits, ShouldNotEqual, bot.Limits)
+			chat := &TwitchChat{auth: owner.Auth, accounts: accounts, limits: NewChatLimits(), hub: NewChatHub()}
+			So(chat.limitsOf(bot.Auth), ShouldEqual, bot.Limits)
+			So(chat.limitsOf(NewMockAuth("", "")), ShouldEqual, chat.limits)
+		})
+		Convey("Accounts which are not logged in cannot send", func() {
+			channel := newTestChannel()
+			chat := &TwitchChat{auth: owner.Auth, current: channel, hub: NewChatHub()}
+			So(chat.SendAs(bot, "", newOutgoingText("hello")), ShouldNotBeNil)
+			So(chat.SendAs(bot, "#elsewhere", newOutgoingText("hello")), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Test connections sending as another account", t, func() {
+		channel := newTestChannel()
+		channel.Config.SendOnly = true
+		channel.addPending(newOutgoingText("hello"))
+
+		Convey("Only the acknowledgement is reported, the main connection shows the message", func() {
+			channel.emitSendAck(channel.popPending())
+			ev := <-channel.ReadFromChannel
+			So(ev.Type, ShouldEqual, EventSendAck)
+			So(channel.ReadFromChannel, ShouldBeEmpty)
+		})
+	})
+}
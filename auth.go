@@ -16,27 +16,118 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Twitch's client id, twicciand's own unless the config names another
+var twitchClientId = "mya9g4l7ucpsbwe2sjlj749d4hqzvvj"
+
+// Scopes requested when logging in
+const twitchScopes = "user_read user_follows_edit user_subscriptions chat:read chat:edit whispers:read whispers:edit"
 
-	"github.com/gorilla/handlers"
+// Twitch's OAuth endpoints
+var (
+	oauthAuthorizeUrl = "https://id.twitch.tv/oauth2/authorize"
+	oauthTokenUrl     = "https://id.twitch.tv/oauth2/token"
+	oauthRevokeUrl    = "https://id.twitch.tv/oauth2/revoke"
+	oauthDeviceUrl    = "https://id.twitch.tv/oauth2/device"
+	oauthValidateUrl  = "https://id.twitch.tv/oauth2/validate"
 )
 
-// Generic Authentication provider interface
+// Generic Authentication provider interface. Providers may be used from
+// several goroutines at once, and tell watchers whenever the credentials change.
 type Auth interface {
 	isAuthenticated() bool
 	setCredentials(user string, pass string)
+	User() string
+	Token() string
+	HasScope(scope string) bool
+	CanRefresh() bool
+	// Refresh replaces the failed token, unless another refresh already did
+	Refresh(failed string) error
+	Watch(fn func(auth Auth))
 }
 
-// Create a type for Twitch authentication
+// Create a type for Twitch authentication. The credentials are guarded by
+// lock once the auth object is shared, other goroutines read them through
+// the accessors.
 type TwitchAuth struct {
-	Username string
-	Password string
+	Username         string
+	Password         string        // The access token
+	RefreshToken     string        // Exchanged for a new access token once it expires
+	ExpiresAt        time.Time     // When the access token expires, zero if unknown
+	ClientSecret     string        // Only needed when twitch requires one for the client id
+	DeviceFlow       bool          // Log in with a code entered on another device instead of the loopback redirect
+	ValidateInterval time.Duration // How often ValidateLoop checks the token, hourly when zero
+	UserId           string
+	Scopes           []string  // Scopes granted to the token, nil until it is validated
+	Validated        time.Time // When twitch last confirmed the token
+	Invalid          bool      // Twitch rejected the token, it has to be replaced by logging in
+
+	OnLogin func(auth *TwitchAuth) // Called after Login received new tokens
+
+	watchers    []func(auth Auth) // Called after the credentials changed
+	flow        *pkceFlow         // The login waiting for twitch's redirect
+	device      *deviceCode       // The login waiting for a code to be entered
+	rescheduled chan struct{}     // Wakes ValidateLoop after the interval changed
+	lock        sync.RWMutex
+	flowLock    sync.Mutex
+	refreshLock sync.Mutex
+}
+
+// Tokens returned by twitch's token endpoint
+type oauthToken struct {
+	AccessToken  string   `json:"access_token"`
+	RefreshToken string   `json:"refresh_token"`
+	ExpiresIn    int      `json:"expires_in"`
+	Scope        []string `json:"scope"`
+}
+
+// State of a login, see RFC 7636 for the code verifier and challenge. The
+// state parameter ties twitch's redirect to the login which asked for it.
+type pkceFlow struct {
+	verifier string
+	state    string
+	done     chan *oauthToken
+}
+
+// What auth.status and isAuthenticated report
+type AuthStatus struct {
+	Authenticated bool       `json:"authenticated"`
+	Username      string     `json:"username,omitempty"`
+	UserId        string     `json:"user_id,omitempty"`
+	Scopes        []string   `json:"scopes,omitempty"`
+	MissingScopes []string   `json:"missing_scopes,omitempty"`
+	Validated     *time.Time `json:"validated,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	CanRefresh    bool       `json:"can_refresh"`
+	LoginUrl      string     `json:"login_url,omitempty"` // Set while waiting for the user to log in
+	UserCode      string     `json:"user_code,omitempty"` // Code to enter at LoginUrl for device logins
+}
+
+// Error answered by twitch's token endpoint
+type oauthError struct {
+	Status int
+	Code   string // Such as authorization_pending, when twitch says
+}
+
+func (err *oauthError) Error() string {
+	return fmt.Sprintf("Twitch refused the token request: %d %s", err.Status, err.Code)
 }
 
 // Check if a authentication object has credentials stored
 func (auth *TwitchAuth) isAuthenticated() bool {
+	auth.lock.RLock()
+	defer auth.lock.RUnlock()
 	if auth.Username != "" && auth.Password != "" {
 		return true
 	} else {
@@ -46,37 +137,353 @@ func (auth *TwitchAuth) isAuthenticated() bool {
 
 // Store both credentials into the authentication object
 func (auth *TwitchAuth) setCredentials(user string, pass string) {
+	auth.lock.Lock()
 	auth.Username = user
 	auth.Password = pass
+	auth.lock.Unlock()
+	auth.changed()
+}
+
+// The login of the account the token belongs to
+func (auth *TwitchAuth) User() string {
+	auth.lock.RLock()
+	defer auth.lock.RUnlock()
+	return auth.Username
+}
+
+// The access token, empty when not logged in
+func (auth *TwitchAuth) Token() string {
+	auth.lock.RLock()
+	defer auth.lock.RUnlock()
+	return auth.Password
+}
+
+// Check if an expired token can be replaced without logging in again
+func (auth *TwitchAuth) CanRefresh() bool {
+	auth.lock.RLock()
+	defer auth.lock.RUnlock()
+	return auth.RefreshToken != ""
+}
+
+// Call fn whenever the credentials change, such as after a refresh, login or logout
+func (auth *TwitchAuth) Watch(fn func(auth Auth)) {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	auth.watchers = append(auth.watchers, fn)
+}
+
+// Tell the watchers about new credentials, which must be called without holding the lock
+func (auth *TwitchAuth) changed() {
+	auth.lock.RLock()
+	watchers := make([]func(auth Auth), len(auth.watchers))
+	copy(watchers, auth.watchers)
+	auth.lock.RUnlock()
+	for _, fn := range watchers {
+		fn(auth)
+	}
+}
+
+// Report the login state
+func (auth *TwitchAuth) Status() *AuthStatus {
+	auth.lock.RLock()
+	status := new(AuthStatus)
+	status.Authenticated = auth.Password != "" && !auth.Invalid
+	status.Username = auth.Username
+	status.UserId = auth.UserId
+	status.Scopes = auth.Scopes
+	status.MissingScopes = auth.missingScopes()
+	status.CanRefresh = auth.RefreshToken != ""
+	if !auth.Validated.IsZero() {
+		validated := auth.Validated
+		status.Validated = &validated
+	}
+	if !auth.ExpiresAt.IsZero() {
+		expires := auth.ExpiresAt
+		status.ExpiresAt = &expires
+	}
+	auth.lock.RUnlock()
+
+	auth.flowLock.Lock()
+	if auth.device != nil {
+		status.LoginUrl = auth.device.VerificationUri
+		status.UserCode = auth.device.UserCode
+	} else if auth.flow != nil {
+		status.LoginUrl = auth.flow.authorizeUrl()
+	}
+	auth.flowLock.Unlock()
+	return status
+}
+
+// Store tokens received from twitch
+func (auth *TwitchAuth) setTokens(token *oauthToken) {
+	auth.lock.Lock()
+	auth.Password = token.AccessToken
+	auth.Invalid = false
+	if token.RefreshToken != "" {
+		auth.RefreshToken = token.RefreshToken
+	}
+	auth.ExpiresAt = time.Time{}
+	if token.ExpiresIn > 0 {
+		auth.ExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	auth.lock.Unlock()
+	auth.changed()
+}
+
+// Get a new access token with the refresh token. failed is the access token
+// which was rejected, nothing is done if another refresh already replaced it.
+func (auth *TwitchAuth) Refresh(failed string) error {
+	auth.refreshLock.Lock()
+	defer auth.refreshLock.Unlock()
+	auth.lock.RLock()
+	current, refreshToken := auth.Password, auth.RefreshToken
+	auth.lock.RUnlock()
+	if current != failed {
+		return nil
+	}
+	if refreshToken == "" {
+		return fmt.Errorf("No refresh token, please log in again")
+	}
+
+	token, err := auth.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return err
+	}
+	log.Print("Refreshed the auth token")
+	auth.setTokens(token)
+	return nil
+}
+
+// Forget the tokens, revoking the access token with twitch, and wait for a new login
+func (auth *TwitchAuth) Logout() {
+	if token := auth.Token(); token != "" {
+		response, err := http.PostForm(oauthRevokeUrl, url.Values{
+			"client_id": {twitchClientId},
+			"token":     {token},
+		})
+		if err != nil {
+			log.Print("Could not revoke the auth token: ", err)
+		} else {
+			response.Body.Close()
+		}
+	}
+
+	auth.lock.Lock()
+	auth.Username = ""
+	auth.Password = ""
+	auth.RefreshToken = ""
+	auth.ExpiresAt = time.Time{}
+	auth.UserId = ""
+	auth.Scopes = nil
+	auth.Validated = time.Time{}
+	auth.Invalid = false
+	auth.lock.Unlock()
+	auth.changed()
+	go auth.Login()
 }
 
-// Below are the functions to create a webserver to recieve credentials from Twitch
+// Wait for the user to log in, then let OnLogin know
+func (auth *TwitchAuth) Login() {
+	if auth.DeviceFlow {
+		if !auth.startDeviceLogin() {
+			// The client's login lets OnLogin know
+			return
+		}
+	} else if !auth.startAuthServer() {
+		// A login started earlier receives the tokens and lets OnLogin know
+		return
+	}
+	if auth.OnLogin != nil {
+		auth.OnLogin(auth)
+	}
+}
 
-// Handle our captive portal's post containing the token and allowed scopes
-func handle_twitch_auth(com chan string) http.HandlerFunc {
-	// Return a function which will receive the posted value and push it down the channel
-	return func(w http.ResponseWriter, r *http.Request) {
-		com <- r.PostFormValue("token")
+// Start a login in the background for a client unless one is already
+// waiting, the url to visit is in Status afterwards
+func (auth *TwitchAuth) StartLogin() error {
+	if auth.DeviceFlow {
+		_, err := auth.DeviceLogin()
+		return err
+	}
+	flow, started, err := auth.beginBrowserLogin()
+	if err != nil {
+		return err
+	}
+	if started {
+		go func() {
+			auth.finishBrowserLogin(flow)
+			if auth.OnLogin != nil {
+				auth.OnLogin(auth)
+			}
+		}()
 	}
+	return nil
 }
 
-// Start the webserver and block until we get credentials
-func (auth *TwitchAuth) startAuthServer() {
-	fmt.Println("Starting Auth server")
-	// Create a channel to pass to the webserver handler
-	com := make(chan string, 0)
+// Call the token endpoint, adding the client's credentials to the form
+func (auth *TwitchAuth) requestToken(form url.Values) (*oauthToken, error) {
+	form.Set("client_id", twitchClientId)
+	if auth.ClientSecret != "" {
+		form.Set("client_secret", auth.ClientSecret)
+	}
+	response, err := http.PostForm(oauthTokenUrl, form)
+	if err != nil {
+		return nil, fmt.Errorf("Could not reach twitch: %s", err)
+	}
+	defer response.Body.Close()
 
-	// Catch Twitch's authentication redirect which contains the token and list of scopes
-	http.Handle("/", http.FileServer(http.Dir("/usr/share/twicciand/auth_server")))
-	// Recieve a post containing the token and list of scopes from our original capture page
-	http.HandleFunc("/recv_auth", handle_twitch_auth(com))
-	go http.ListenAndServe(":19210", handlers.LoggingHandler(os.Stdout, http.DefaultServeMux))
+	if response.StatusCode != http.StatusOK {
+		// Twitch puts the reason in message, RFC 6749 in error
+		var failure struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(response.Body).Decode(&failure)
+		code := failure.Error
+		if code == "" || code == http.StatusText(response.StatusCode) {
+			code = failure.Message
+		}
+		return nil, &oauthError{Status: response.StatusCode, Code: code}
+	}
+	token := new(oauthToken)
+	if err = json.NewDecoder(response.Body).Decode(token); err != nil {
+		return nil, fmt.Errorf("Could not parse twitch's token: %s", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("Twitch did not send an access token")
+	}
+	return token, nil
+}
+
+// Start a login with a fresh code verifier
+func newPkceFlow() *pkceFlow {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		log.Print("Could not generate a code verifier: ", err)
+	}
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		log.Print("Could not generate a login state: ", err)
+	}
+	flow := new(pkceFlow)
+	flow.verifier = base64.RawURLEncoding.EncodeToString(random)
+	flow.state = base64.RawURLEncoding.EncodeToString(state)
+	flow.done = make(chan *oauthToken, 1)
+	return flow
+}
+
+// The S256 code challenge sent with the authorization request
+func (flow *pkceFlow) challenge() string {
+	sum := sha256.Sum256([]byte(flow.verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Page the user visits to log in
+func (flow *pkceFlow) authorizeUrl() string {
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {twitchClientId},
+		"redirect_uri":          {authServer.RedirectUrl()},
+		"scope":                 {twitchScopes},
+		"state":                 {flow.state},
+		"code_challenge":        {flow.challenge()},
+		"code_challenge_method": {"S256"},
+	}
+	return oauthAuthorizeUrl + "?" + query.Encode()
+}
+
+// Handle twitch's redirect, exchanging the authorization code for tokens.
+// Returns true once the login received its tokens.
+func (auth *TwitchAuth) handleCallback(w http.ResponseWriter, r *http.Request) bool {
+	auth.flowLock.Lock()
+	flow := auth.flow
+	auth.flowLock.Unlock()
+
+	query := r.URL.Query()
+	if flow == nil || query.Get("state") != flow.state {
+		writeAuthPage(w, http.StatusBadRequest, "This login link is not valid anymore, please start a new login.")
+		return false
+	}
+	if reason := query.Get("error"); reason != "" {
+		writeAuthPage(w, http.StatusBadRequest, "Twitch did not log you in: "+query.Get("error_description"))
+		return false
+	}
+	code := query.Get("code")
+	if code == "" {
+		writeAuthPage(w, http.StatusBadRequest, "Twitch did not send an authorization code.")
+		return false
+	}
+
+	token, err := auth.requestToken(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"code_verifier": {flow.verifier},
+		"redirect_uri":  {authServer.RedirectUrl()},
+	})
+	if err != nil {
+		log.Print(err)
+		writeAuthPage(w, http.StatusBadGateway, err.Error())
+		return false
+	}
+
+	auth.flowLock.Lock()
+	if auth.flow == flow {
+		auth.flow = nil
+	}
+	auth.flowLock.Unlock()
+	flow.done <- token
+	writeAuthPage(w, http.StatusOK, "Twicciand is logged in, you can close this window.")
+	return true
+}
+
+// Start the webserver and block until we get credentials. Returns false
+// right away when another login is already waiting for them, or when the
+// webserver could not be started.
+func (auth *TwitchAuth) startAuthServer() bool {
+	flow, started, err := auth.beginBrowserLogin()
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	if !started {
+		return false
+	}
+	auth.finishBrowserLogin(flow)
+	return true
+}
+
+// Start a login through the browser unless one is already waiting. When the
+// webserver cannot be started no login is left waiting, so it can be retried.
+func (auth *TwitchAuth) beginBrowserLogin() (*pkceFlow, bool, error) {
+	auth.flowLock.Lock()
+	if auth.flow != nil {
+		defer auth.flowLock.Unlock()
+		return auth.flow, false, nil
+	}
+	flow := newPkceFlow()
+	auth.flow = flow
+	auth.flowLock.Unlock()
+	if err := authServer.Add(flow.state, auth); err != nil {
+		auth.flowLock.Lock()
+		if auth.flow == flow {
+			auth.flow = nil
+		}
+		auth.flowLock.Unlock()
+		return nil, false, err
+	}
 
 	// Print instructions
 	fmt.Println("Waiting for authentication token...")
-	fmt.Println("Please visit", "https://api.twitch.tv/kraken/oauth2/authorize?response_type=token&client_id=mya9g4l7ucpsbwe2sjlj749d4hqzvvj&redirect_uri=http://localhost:19210&scope=user_read+user_follows_edit+user_subscriptions+chat_login", "to generate an authentication token")
+	fmt.Println("Please visit", flow.authorizeUrl(), "to log in")
+	return flow, true, nil
+}
 
-	// Receive auth token from the channel
-	auth.Password = <-com
-	fmt.Println("Auth server received:", auth.Password)
+// Wait for the browser login to complete, storing the tokens
+func (auth *TwitchAuth) finishBrowserLogin(flow *pkceFlow) {
+	// Receive the tokens from the redirect handler
+	auth.setTokens(<-flow.done)
+	fmt.Println("Auth server received a token")
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Sent to websocket and RPC clients once a login completes
+const EventAuthCompleted = "auth.completed"
+
+// A device login, as returned by twitch's device endpoint (RFC 8628)
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationUri string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"` // Seconds to wait between polls
+
+	done chan struct{} // Closed once the single poller of the code is finished
+	err  error         // Why the login failed, set before done is closed
+}
+
+// What auth.device returns
+type DeviceLogin struct {
+	UserCode        string `json:"user_code"`
+	VerificationUri string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+}
+
+// Ask twitch for a code the user enters on another device
+func (auth *TwitchAuth) requestDeviceCode() (*deviceCode, error) {
+	response, err := http.PostForm(oauthDeviceUrl, url.Values{
+		"client_id": {twitchClientId},
+		"scopes":    {twitchScopes},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not reach twitch: %s", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Twitch refused the device login: %s", response.Status)
+	}
+
+	device := new(deviceCode)
+	if err = json.NewDecoder(response.Body).Decode(device); err != nil {
+		return nil, fmt.Errorf("Could not parse twitch's device code: %s", err)
+	}
+	if device.Interval <= 0 {
+		device.Interval = 5
+	}
+	return device, nil
+}
+
+// Poll the token endpoint until the user entered the code, or the code expired
+func (auth *TwitchAuth) pollDeviceToken(device *deviceCode) (*oauthToken, error) {
+	interval := time.Duration(device.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		token, err := auth.requestToken(url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {device.DeviceCode},
+			"scopes":      {twitchScopes},
+		})
+		if failure, ok := err.(*oauthError); ok {
+			switch failure.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += 5 * time.Second
+				continue
+			}
+		}
+		return token, err
+	}
+	return nil, fmt.Errorf("The device code expired before it was entered")
+}
+
+// Start a device login unless one is already waiting, returning the code to
+// enter and whether the caller started it. Only the caller starting a login
+// polls twitch for its token, a code polled twice can be answered with
+// slow_down or have its token handed out twice.
+func (auth *TwitchAuth) beginDeviceLogin() (*deviceCode, bool, error) {
+	auth.flowLock.Lock()
+	device := auth.device
+	auth.flowLock.Unlock()
+	if device != nil {
+		return device, false, nil
+	}
+
+	// Twitch is asked without the lock, which Status needs meanwhile
+	device, err := auth.requestDeviceCode()
+	if err != nil {
+		return nil, false, err
+	}
+	auth.flowLock.Lock()
+	defer auth.flowLock.Unlock()
+	if auth.device != nil {
+		// Another login started while we asked, ours is left to expire
+		return auth.device, false, nil
+	}
+	device.done = make(chan struct{})
+	auth.device = device
+	return device, true, nil
+}
+
+// Wait for the code of a device login to be entered, storing the tokens. Only
+// called by whoever started the login.
+func (auth *TwitchAuth) finishDeviceLogin(device *deviceCode) error {
+	token, err := auth.pollDeviceToken(device)
+	if err == nil {
+		auth.setTokens(token)
+	}
+	auth.flowLock.Lock()
+	if auth.device == device {
+		auth.device = nil
+	}
+	auth.flowLock.Unlock()
+	device.err = err
+	close(device.done)
+	return err
+}
+
+// Log in with a device code, asking for a new code whenever one expires. Blocks
+// until logged in, returning false when a login a client started did it, whose
+// poller lets OnLogin know.
+func (auth *TwitchAuth) startDeviceLogin() bool {
+	for {
+		device, started, err := auth.beginDeviceLogin()
+		if err != nil {
+			log.Print(err)
+			time.Sleep(30 * time.Second)
+			continue
+		}
+		fmt.Println("To log in, visit", device.VerificationUri, "on any device and enter the code", device.UserCode)
+		if started {
+			err = auth.finishDeviceLogin(device)
+		} else {
+			// A client started the login, its poller tells how it went
+			<-device.done
+			if err = device.err; err == nil {
+				return false
+			}
+		}
+		if err == nil {
+			return true
+		}
+		log.Print("Device login failed: ", err)
+	}
+}
+
+// Start a device login in the background for a client, OnLogin is called once it completes
+func (auth *TwitchAuth) DeviceLogin() (*DeviceLogin, error) {
+	device, started, err := auth.beginDeviceLogin()
+	if err != nil {
+		return nil, err
+	}
+	if started {
+		go func() {
+			if err := auth.finishDeviceLogin(device); err != nil {
+				log.Print("Device login failed: ", err)
+				return
+			}
+			if auth.OnLogin != nil {
+				auth.OnLogin(auth)
+			}
+		}()
+	}
+	return &DeviceLogin{UserCode: device.UserCode, VerificationUri: device.VerificationUri, ExpiresIn: device.ExpiresIn}, nil
+}
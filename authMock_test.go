@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/sorcix/irc"
+)
+
+// An auth provider handing out whatever credentials a test gives it
+type MockAuth struct {
+	user      string
+	token     string
+	scopes    []string // nil grants every scope
+	refreshes int
+	watchers  []func(auth Auth)
+	lock      sync.Mutex
+}
+
+func NewMockAuth(user string, token string) *MockAuth {
+	auth := new(MockAuth)
+	auth.user = user
+	auth.token = token
+	return auth
+}
+
+func (auth *MockAuth) isAuthenticated() bool {
+	return auth.User() != "" && auth.Token() != ""
+}
+
+func (auth *MockAuth) setCredentials(user string, pass string) {
+	auth.lock.Lock()
+	auth.user = user
+	auth.token = pass
+	watchers := append([]func(auth Auth){}, auth.watchers...)
+	auth.lock.Unlock()
+	for _, fn := range watchers {
+		fn(auth)
+	}
+}
+
+func (auth *MockAuth) User() string {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	return auth.user
+}
+
+func (auth *MockAuth) Token() string {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	return auth.token
+}
+
+func (auth *MockAuth) HasScope(scope string) bool {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	if auth.scopes == nil {
+		return true
+	}
+	for _, granted := range auth.scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (auth *MockAuth) CanRefresh() bool {
+	return true
+}
+
+// Refreshing hands out token-1, token-2 and so on
+func (auth *MockAuth) Refresh(failed string) error {
+	auth.lock.Lock()
+	if auth.token != failed {
+		auth.lock.Unlock()
+		return nil
+	}
+	auth.refreshes++
+	token := fmt.Sprintf("token-%d", auth.refreshes)
+	user := auth.user
+	auth.lock.Unlock()
+	auth.setCredentials(user, token)
+	return nil
+}
+
+func (auth *MockAuth) Watch(fn func(auth Auth)) {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	auth.watchers = append(auth.watchers, fn)
+}
+
+func TestAuthProvider(t *testing.T) {
+	Convey("Test what uses an auth provider", t, func() {
+		auth := NewMockAuth("someone", "token")
+
+		Convey("Api answers are cached until the token changes", func() {
+			requests := 0
+			twitch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if r.Header.Get("Authorization") == "OAuth token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprintf(w, `{"request":%d}`, requests)
+			}))
+			defer twitch.Close()
+			api := NewTwitchApi(auth)
+			api.cache.SetTTL(time.Minute)
+
+			get := func() string {
+				var url bytes.Buffer
+				url.WriteString(twitch.URL + "/games")
+				result := getCachedApiUrl(url, api)
+				return result.String()
+			}
+			So(get(), ShouldEqual, `{"request":2}`)
+			So(get(), ShouldEqual, `{"request":2}`)
+			So(auth.Token(), ShouldEqual, "token-1")
+
+			auth.setCredentials("someone", "token-2")
+			So(get(), ShouldEqual, `{"request":3}`)
+
+			// Answers about the user are not cached
+			var url bytes.Buffer
+			url.WriteString(twitch.URL + "/user")
+			result := getApiUrl(url, api)
+			So(result.String(), ShouldEqual, `{"request":4}`)
+		})
+		Convey("Nothing is cached by default", func() {
+			So(DefaultConfig().Cache.ApiTTL.Duration, ShouldEqual, time.Duration(0))
+		})
+		Convey("Chat logs in again when the user changes", func() {
+			channel := newTestChannel()
+			channel.Config.Password = "token"
+			conn, server := net.Pipe()
+			channel.Conn = conn
+			chat := &TwitchChat{auth: auth, channels: []*IrcChannel{channel}, hub: NewChatHub()}
+			auth.Watch(chat.authChanged)
+
+			// A refreshed token is used the next time the channel connects
+			auth.setCredentials("test_user", "token-2")
+			So(channel.Config.Password, ShouldEqual, "token-2")
+			lines := irc.NewDecoder(server)
+			go conn.Write([]byte("PING\r\n"))
+			_, err := lines.Decode()
+			So(err, ShouldBeNil)
+
+			auth.setCredentials("", "")
+			_, err = lines.Decode()
+			So(err, ShouldNotBeNil)
+			So(chat.CanSend(), ShouldBeFalse)
+		})
+		Convey("Events read who we are while the user changes", func() {
+			channel := newTestChannel()
+			channel.Conn, _ = net.Pipe()
+			chat := &TwitchChat{auth: auth, channels: []*IrcChannel{channel}, hub: NewChatHub()}
+			auth.Watch(chat.authChanged)
+
+			changed := make(chan bool)
+			go func() {
+				auth.setCredentials("another_user", "token-2")
+				changed <- true
+			}()
+			channel.handleUserState(irc.ParseMessage(`@display-name=Test_User :tmi.twitch.tv USERSTATE #test_channel`))
+			<-changed
+			So(channel.username(), ShouldEqual, "another_user")
+		})
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Port twitch sends the browser back to unless auth_port is set
+const defaultAuthPort = 19210
+
+// The page answering the browser, kept in the binary so nothing has to be installed
+//
+//go:embed authPage.html
+var authPageSource string
+
+var authPage = template.Must(template.New("auth").Parse(authPageSource))
+
+// Receives twitch's redirects on a mux of its own, listening only while a
+// browser login waits. Each redirect goes to the login whose random state it
+// carries, so requests made up by other pages are turned away.
+type AuthServer struct {
+	Port     int                    // Port to listen on, 0 for any free port
+	flows    map[string]*TwitchAuth // Logins waiting for their redirect, by state
+	server   *http.Server
+	listener net.Listener
+	lock     sync.Mutex
+}
+
+// The server every account's browser login goes through
+var authServer = NewAuthServer(defaultAuthPort)
+
+func NewAuthServer(port int) *AuthServer {
+	server := new(AuthServer)
+	server.Port = port
+	server.flows = make(map[string]*TwitchAuth)
+	return server
+}
+
+// Address twitch sends the browser back to
+func (server *AuthServer) RedirectUrl() string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	port := server.Port
+	if server.listener != nil {
+		port = server.listener.Addr().(*net.TCPAddr).Port
+	}
+	return "http://localhost:" + strconv.Itoa(port) + "/"
+}
+
+// Wait for the redirect of a login, starting to listen if needed
+func (server *AuthServer) Add(state string, auth *TwitchAuth) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.server == nil {
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(server.Port))
+		if err != nil {
+			return fmt.Errorf("Could not start the auth server: %s", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/", server)
+		server.listener = listener
+		server.server = &http.Server{Handler: mux}
+		fmt.Println("Starting Auth server")
+		go server.server.Serve(listener)
+	}
+	server.flows[state] = auth
+	return nil
+}
+
+// Stop waiting for a login's redirect, shutting down once no login waits
+func (server *AuthServer) Remove(state string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	delete(server.flows, state)
+	if len(server.flows) > 0 || server.server == nil {
+		return
+	}
+
+	// The port is freed right away, the page being answered is still sent
+	running := server.server
+	server.listener.Close()
+	server.server = nil
+	server.listener = nil
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := running.Shutdown(ctx); err != nil {
+			log.Print("Could not shut down the auth server: ", err)
+		}
+	}()
+}
+
+// Hand twitch's redirect to the login it belongs to
+func (server *AuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The query holds the code and state, so only the path is logged
+	logDebug("Auth server: ", r.Method, " ", r.URL.Path)
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	server.lock.Lock()
+	auth := server.flows[state]
+	server.lock.Unlock()
+	if state == "" || auth == nil {
+		writeAuthPage(w, http.StatusBadRequest, "This login link is not valid anymore, please start a new login.")
+		return
+	}
+	if auth.handleCallback(w, r) {
+		server.Remove(state)
+	}
+}
+
+// Answer the browser with a short message
+func writeAuthPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	authPage.Execute(w, struct {
+		Ok      bool
+		Message string
+	}{status == http.StatusOK, message})
+}
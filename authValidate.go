@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Twitch asks for tokens to be validated at least once an hour
+const validateInterval = time.Hour
+
+// Newer scopes which the legacy chat_login scope also grants
+var legacyScopes = map[string]string{
+	"chat:read":     "chat_login",
+	"chat:edit":     "chat_login",
+	"whispers:read": "chat_login",
+	"whispers:edit": "chat_login",
+}
+
+// What twitch's validate endpoint says about a token
+type tokenInfo struct {
+	ClientId  string   `json:"client_id"`
+	Login     string   `json:"login"`
+	UserId    string   `json:"user_id"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"`
+}
+
+// Ask twitch about a token
+func validateToken(token string) (*tokenInfo, error) {
+	req, err := http.NewRequest("GET", oauthValidateUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "OAuth "+token)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not reach twitch: %s", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, &oauthError{Status: response.StatusCode, Code: "invalid token"}
+	}
+	info := new(tokenInfo)
+	if err = json.NewDecoder(response.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("Could not parse twitch's token information: %s", err)
+	}
+	return info, nil
+}
+
+// Check the access token with twitch, refreshing it if twitch rejects it, and
+// record who it belongs to and its scopes. Invalid is set when twitch rejects
+// the token for good; when twitch cannot be reached nothing changes.
+// Watchers are told when the token turns out to belong to another user.
+func (auth *TwitchAuth) Validate() error {
+	token := auth.Token()
+	info, err := validateToken(token)
+	if failure, ok := err.(*oauthError); ok && failure.Status == http.StatusUnauthorized && auth.CanRefresh() {
+		if err = auth.Refresh(token); err == nil {
+			info, err = validateToken(auth.Token())
+		}
+	}
+	if failure, ok := err.(*oauthError); ok && failure.Status == http.StatusUnauthorized {
+		auth.lock.Lock()
+		auth.Invalid = true
+		auth.lock.Unlock()
+		return fmt.Errorf("Twitch rejected the auth token, please log in again")
+	} else if err != nil {
+		return err
+	}
+
+	auth.lock.Lock()
+	renamed := info.Login != "" && info.Login != auth.Username
+	auth.Invalid = false
+	auth.Validated = time.Now()
+	auth.Scopes = info.Scopes
+	auth.UserId = info.UserId
+	if info.Login != "" {
+		auth.Username = info.Login
+	}
+	if info.ExpiresIn > 0 {
+		auth.ExpiresAt = time.Now().Add(time.Duration(info.ExpiresIn) * time.Second)
+	}
+	missing := auth.missingScopes()
+	auth.lock.Unlock()
+
+	if len(missing) > 0 {
+		log.Print("The auth token is missing scopes, some features will not work until you log in again: ", strings.Join(missing, ", "))
+	}
+	if renamed {
+		auth.changed()
+	}
+	return nil
+}
+
+// Validate the token every hour, or every ValidateInterval, for as long as the daemon runs
+func (auth *TwitchAuth) ValidateLoop() {
+	last := time.Now()
+	for {
+		interval, rescheduled := auth.validateSchedule()
+		timer := time.NewTimer(time.Until(last.Add(interval)))
+		select {
+		case <-timer.C:
+		case <-rescheduled:
+			// Wait again, counting from the last check
+			timer.Stop()
+			continue
+		}
+		last = time.Now()
+		if auth.Token() == "" {
+			continue
+		}
+		if err := auth.Validate(); err != nil {
+			log.Print("Could not validate the auth token: ", err)
+		}
+	}
+}
+
+// How often ValidateLoop checks the token, and what wakes it when that changes
+func (auth *TwitchAuth) validateSchedule() (time.Duration, chan struct{}) {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	if auth.rescheduled == nil {
+		auth.rescheduled = make(chan struct{}, 1)
+	}
+	interval := auth.ValidateInterval
+	if interval <= 0 {
+		interval = validateInterval
+	}
+	return interval, auth.rescheduled
+}
+
+// Change how often the token is checked, taking effect right away
+func (auth *TwitchAuth) SetValidateInterval(interval time.Duration) {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	if interval == auth.ValidateInterval {
+		return
+	}
+	auth.ValidateInterval = interval
+	select {
+	case auth.rescheduled <- struct{}{}:
+	default:
+	}
+}
+
+// Check if the token was granted a scope. Before the token is validated
+// its scopes are unknown, and it is assumed to have them all.
+func (auth *TwitchAuth) HasScope(scope string) bool {
+	auth.lock.RLock()
+	defer auth.lock.RUnlock()
+	return auth.hasScope(scope)
+}
+
+func (auth *TwitchAuth) hasScope(scope string) bool {
+	if auth.Scopes == nil {
+		return true
+	}
+	for _, granted := range auth.Scopes {
+		if granted == scope || granted == legacyScopes[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+// Scopes twicciand asks for which the token was not granted
+func (auth *TwitchAuth) MissingScopes() []string {
+	auth.lock.RLock()
+	defer auth.lock.RUnlock()
+	return auth.missingScopes()
+}
+
+func (auth *TwitchAuth) missingScopes() []string {
+	missing := []string{}
+	for _, scope := range strings.Fields(twitchScopes) {
+		if !auth.hasScope(scope) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
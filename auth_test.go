@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/walle/cfg"
+)
+
+func TestAuth(t *testing.T) {
+	Convey("Test the code challenge of a login", t, func() {
+		flow := &pkceFlow{verifier: "dBjftJeZ4CVP-mJ92K9bUHb8L8h6Wgj-5qgv0ptq0hbu"}
+		So(flow.challenge(), ShouldEqual, "nPIqZPKBCDcCQekI04xlNkZZcYeVq4eQJho6dH-kB9c")
+		So(flow.authorizeUrl(), ShouldContainSubstring, "code_challenge_method=S256")
+	})
+
+	Convey("Test starting a login for a client", t, func() {
+		defer func(old *AuthServer) { authServer = old }(authServer)
+		authServer = NewAuthServer(0)
+		auth := new(TwitchAuth)
+		So(auth.StartLogin(), ShouldBeNil)
+		url := auth.Status().LoginUrl
+		So(url, ShouldStartWith, oauthAuthorizeUrl)
+
+		// Asking again shows the login already waiting
+		So(auth.StartLogin(), ShouldBeNil)
+		So(auth.Status().LoginUrl, ShouldEqual, url)
+		So(auth.startAuthServer(), ShouldBeFalse)
+		So(url, ShouldNotContainSubstring, "localhost%3A0")
+		authServer.Remove(auth.flow.state)
+	})
+
+	Convey("Test a login whose auth server cannot start", t, func() {
+		busy, err := net.Listen("tcp", ":0")
+		So(err, ShouldBeNil)
+		defer busy.Close()
+		defer func(old *AuthServer) { authServer = old }(authServer)
+		authServer = NewAuthServer(busy.Addr().(*net.TCPAddr).Port)
+
+		auth := new(TwitchAuth)
+		So(auth.StartLogin(), ShouldNotBeNil)
+		So(auth.Status().LoginUrl, ShouldBeEmpty)
+
+		// Once the port is free the login can be tried again
+		busy.Close()
+		So(auth.StartLogin(), ShouldBeNil)
+		So(auth.Status().LoginUrl, ShouldNotBeEmpty)
+		authServer.Remove(auth.flow.state)
+	})
+
+	Convey("Test refreshing an expired token", t, func() {
+		refreshes := 0
+		twitch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/token":
+				refreshes++
+				if r.PostFormValue("refresh_token") != "refresh" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				fmt.Fprint(w, `{"access_token":"fresh","refresh_token":"refresh2","expires_in":3600}`)
+			default:
+				if r.Header.Get("Authorization") != "OAuth fresh" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprint(w, `{"name":"someone"}`)
+			}
+		}))
+		defer twitch.Close()
+		defer func(old string) { oauthTokenUrl = old }(oauthTokenUrl)
+		oauthTokenUrl = twitch.URL + "/token"
+
+		saved := 0
+		auth := &TwitchAuth{Password: "stale", RefreshToken: "refresh"}
+		auth.Watch(func(Auth) { saved++ })
+		api := NewTwitchApi(auth)
+
+		var url bytes.Buffer
+		url.WriteString(twitch.URL + "/user")
+		result := getApiUrl(url, api)
+		So(result.String(), ShouldEqual, `{"name":"someone"}`)
+		So(auth.Password, ShouldEqual, "fresh")
+		So(auth.RefreshToken, ShouldEqual, "refresh2")
+		So(auth.ExpiresAt.IsZero(), ShouldBeFalse)
+		So(saved, ShouldEqual, 1)
+
+		Convey("A token refreshed meanwhile is not refreshed again", func() {
+			So(auth.Refresh("stale"), ShouldBeNil)
+			So(refreshes, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestAuthServer(t *testing.T) {
+	Convey("Test receiving twitch's redirect", t, func() {
+		twitch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"access_token":"token","expires_in":3600}`)
+		}))
+		defer twitch.Close()
+		defer func(old string) { oauthTokenUrl = old }(oauthTokenUrl)
+		oauthTokenUrl = twitch.URL + "/token"
+
+		server := NewAuthServer(0)
+		auth := new(TwitchAuth)
+		flow := newPkceFlow()
+		auth.flow = flow
+		server.flows[flow.state] = auth
+		So(flow.authorizeUrl(), ShouldContainSubstring, "state="+flow.state)
+
+		Convey("A redirect without the login's state is refused", func() {
+			page := httptest.NewRecorder()
+			server.ServeHTTP(page, httptest.NewRequest("GET", "/?code=abc&state=forged", nil))
+			So(page.Code, ShouldEqual, http.StatusBadRequest)
+			So(page.Body.String(), ShouldContainSubstring, "Login failed")
+			So(auth.flow, ShouldEqual, flow)
+		})
+		Convey("The login's redirect completes it", func() {
+			page := httptest.NewRecorder()
+			server.ServeHTTP(page, httptest.NewRequest("GET", "/?code=abc&state="+flow.state, nil))
+			So(page.Code, ShouldEqual, http.StatusOK)
+			So(page.Body.String(), ShouldContainSubstring, "Logged in")
+			So((<-flow.done).AccessToken, ShouldEqual, "token")
+			So(server.flows, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestDeviceLogin(t *testing.T) {
+	Convey("Test logging in with a device code", t, func() {
+		polls := 0
+		twitch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/device":
+				fmt.Fprint(w, `{"device_code":"dev","user_code":"ABCD-EFGH","verification_uri":"https://www.twitch.tv/activate","expires_in":60,"interval":1}`)
+			case "/token":
+				polls++
+				if r.PostFormValue("device_code") != "dev" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if polls == 1 {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, `{"status":400,"message":"authorization_pending"}`)
+					return
+				}
+				fmt.Fprint(w, `{"access_token":"device-token","refresh_token":"refresh","expires_in":3600}`)
+			}
+		}))
+		defer twitch.Close()
+		defer func(device string, token string) { oauthDeviceUrl, oauthTokenUrl = device, token }(oauthDeviceUrl, oauthTokenUrl)
+		oauthDeviceUrl = twitch.URL + "/device"
+		oauthTokenUrl = twitch.URL + "/token"
+
+		completed := make(chan *TwitchAuth, 1)
+		auth := new(TwitchAuth)
+		auth.OnLogin = func(auth *TwitchAuth) { completed <- auth }
+
+		login, err := auth.DeviceLogin()
+		So(err, ShouldBeNil)
+		So(login.UserCode, ShouldEqual, "ABCD-EFGH")
+		So(auth.Status().UserCode, ShouldEqual, "ABCD-EFGH")
+
+		// Asking again while waiting returns the same code
+		again, err := auth.DeviceLogin()
+		So(err, ShouldBeNil)
+		So(again.UserCode, ShouldEqual, login.UserCode)
+
+		Convey("The daemon's login waits for the client's poller", func() {
+			loggedIn := make(chan bool)
+			go func() { loggedIn <- auth.startDeviceLogin() }()
+			So((<-completed).Password, ShouldEqual, "device-token")
+			So(<-loggedIn, ShouldBeFalse)
+			So(polls, ShouldEqual, 2)
+			So(auth.Status().UserCode, ShouldEqual, "")
+		})
+	})
+
+	Convey("Test the status while twitch is slow to hand out a device code", t, func() {
+		asked, release := make(chan bool), make(chan bool)
+		twitch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			asked <- true
+			<-release
+			fmt.Fprint(w, `{"device_code":"dev","user_code":"ABCD-EFGH","verification_uri":"https://www.twitch.tv/activate","expires_in":60,"interval":1}`)
+		}))
+		defer twitch.Close()
+		defer func(old string) { oauthDeviceUrl = old }(oauthDeviceUrl)
+		oauthDeviceUrl = twitch.URL
+
+		auth := new(TwitchAuth)
+		started := make(chan bool)
+		go func() {
+			_, began, _ := auth.beginDeviceLogin()
+			started <- began
+		}()
+		<-asked
+
+		status := make(chan *AuthStatus)
+		go func() { status <- auth.Status() }()
+		select {
+		case current := <-status:
+			So(current.UserCode, ShouldEqual, "")
+		case <-time.After(time.Second):
+			t.Error("Status waited for twitch")
+		}
+		close(release)
+		So(<-started, ShouldBeTrue)
+		So(auth.Status().UserCode, ShouldEqual, "ABCD-EFGH")
+	})
+}
+
+func TestValidate(t *testing.T) {
+	Convey("Test validating the token", t, func() {
+		twitch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "OAuth good" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"client_id":"id","login":"someone","user_id":"42","scopes":["user_read","chat:read"],"expires_in":0}`)
+		}))
+		defer twitch.Close()
+		defer func(old string) { oauthValidateUrl = old }(oauthValidateUrl)
+		oauthValidateUrl = twitch.URL
+
+		Convey("The token's user and scopes are recorded", func() {
+			auth := &TwitchAuth{Password: "good"}
+			So(auth.HasScope("chat:edit"), ShouldBeTrue)
+			So(auth.Validate(), ShouldBeNil)
+			So(auth.Username, ShouldEqual, "someone")
+			So(auth.UserId, ShouldEqual, "42")
+			So(auth.HasScope("chat:read"), ShouldBeTrue)
+			So(auth.HasScope("chat:edit"), ShouldBeFalse)
+			So(auth.MissingScopes(), ShouldContain, "chat:edit")
+
+			chat := &TwitchChat{auth: auth}
+			So(chat.CanSend(), ShouldBeFalse)
+			So(chat.sendError(newTestChannel(), "chat:edit"), ShouldNotBeNil)
+		})
+		Convey("The legacy chat scope grants the newer chat scopes", func() {
+			auth := &TwitchAuth{Scopes: []string{"chat_login"}}
+			So(auth.HasScope("chat:edit"), ShouldBeTrue)
+		})
+		Convey("A rejected token is marked invalid", func() {
+			auth := &TwitchAuth{Password: "bad", Username: "someone"}
+			So(auth.Validate(), ShouldNotBeNil)
+			So(auth.Invalid, ShouldBeTrue)
+			So(auth.Status().Authenticated, ShouldBeFalse)
+		})
+	})
+}
+
+func TestCredentialStores(t *testing.T) {
+	Convey("Test keeping the credentials", t, func() {
+		dir, err := ioutil.TempDir("", "twicciand")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		auth := &TwitchAuth{Username: "someone", Password: "token", RefreshToken: "refresh", ExpiresAt: time.Now().Round(time.Second)}
+
+		Convey("The memory store keeps what it was given", func() {
+			store := new(memoryStore)
+			saveAuth(store, auth)
+			creds, err := store.Load()
+			So(err, ShouldBeNil)
+			So(creds, ShouldResemble, authCredentials(auth))
+
+			auth.Password = ""
+			saveAuth(store, auth)
+			creds, err = store.Load()
+			So(creds, ShouldBeNil)
+		})
+		Convey("The credentials file can only be read with its key", func() {
+			os.Setenv("TWICCIAND_CREDENTIALS_KEY", "secret")
+			defer os.Unsetenv("TWICCIAND_CREDENTIALS_KEY")
+			store, err := newEncryptedFileStore(path.Join(dir, "credentials"))
+			So(err, ShouldBeNil)
+			So(store.Save(authCredentials(auth)), ShouldBeNil)
+
+			raw, _ := ioutil.ReadFile(path.Join(dir, "credentials"))
+			So(string(raw), ShouldNotContainSubstring, "token")
+			creds, err := store.Load()
+			So(err, ShouldBeNil)
+			So(creds.Token, ShouldEqual, "token")
+			So(creds.ExpiresAt.Equal(auth.ExpiresAt), ShouldBeTrue)
+
+			os.Setenv("TWICCIAND_CREDENTIALS_KEY", "another")
+			other, _ := newEncryptedFileStore(path.Join(dir, "credentials"))
+			_, err = other.Load()
+			So(err, ShouldNotBeNil)
+		})
+		Convey("A token in the config file is moved to the store", func() {
+			conffile := path.Join(dir, "twicciand.conf")
+			ioutil.WriteFile(conffile, nil, 0600)
+			file, err := cfg.NewConfigFile(conffile)
+			So(err, ShouldBeNil)
+			file.Config.SetString("token", "old")
+
+			store := new(memoryStore)
+			migrateCredentials(file, store)
+			creds, _ := store.Load()
+			So(creds.Token, ShouldEqual, "old")
+			token, _ := file.Config.GetString("token")
+			So(token, ShouldEqual, "")
+		})
+	})
+}
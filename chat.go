@@ -4,14 +4,15 @@ package main
 import (
 	//	"bytes"
 	"fmt"
+	"strings"
 	"html"
 	"log"
 	"math"
-	"math/rand"
 	"net"
 	"net/http"
 	"time"
 	"regexp"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/sorcix/irc"			// IRC v3 branch
@@ -19,10 +20,22 @@ import (
 
 type TwitchChat struct {
 	channels	[]*IrcChannel
-	auth		*TwitchAuth
-	curIn		chan []byte
-	curOut		chan []byte
-	colorMap	map[string]string
+	auth		Auth
+	colors		*ColorCache
+	limits		*ChatLimits
+	commands	*ChatCommands
+	history		*ChatHistory
+	hub		*ChatHub
+	highlights	*Highlighter
+	filters		*ChatFilters
+	whispers	*Whispers
+	accounts	*Accounts
+	senders		map[string]*IrcChannel	// connections sending as other accounts, by account and channel
+	server		*ChatServer
+	maxRetries	int		// connection attempts before giving up on a channel
+	replay		int		// events replayed to new websocket clients
+	current		*IrcChannel
+	lock		sync.Mutex
 	mod		[]string	// 0 or 1, unused right now
 	turbo		[]string	// 0 or 1
 	sub		[]string	// 0 or 1
@@ -38,26 +51,58 @@ type IrcChannel struct {
 	Writer          *irc.Encoder
 	Conn            net.Conn
 	RawIrcMessages  chan *irc.Message
-	PostToChannel   chan []byte
-	ReadFromChannel chan []byte
+	PostToChannel   chan *OutgoingMsg
+	ReadFromChannel chan *ChatEvent
+	Colors          *ColorCache
+	History         *ChatHistory
+	Highlights      *Highlighter
+	Filters         *ChatFilters
+	Whispers        *Whispers
+	Anonymous       bool // Logged in as justinfan, chat can be read but not written
 	Config          *IrcConfig
+	RoomState       RoomState
+	UserState       map[string]string
+	GlobalUserState map[string]string
+	pending         []*OutgoingMsg
+	lastSent        string
+	lastSentText    string
+	lastSentTime    time.Time
+	lastDepth       int
 	retries         int
+	health          channelHealth
+	readClosed      bool // ReadFromChannel was closed by Sort, guarded by emitLock
+	stateLock       sync.Mutex
+	sendLock        sync.Mutex
+	emitLock        sync.Mutex
+	done            chan struct{}
+	disconnect      sync.Once
 }
 
 type IrcConfig struct {
-	Server     string
+	Server     *ChatServer
 	Username   string
 	Password   string
 	MaxRetries int
+	Limits     *ChatLimits
+	SendOnly   bool // Only used to send as another account, the main connection shows the channel
 }
 
-func CreateIrcChannel(name string, cfg *IrcConfig) (*IrcChannel, error) {
+func CreateIrcChannel(name string, cfg *IrcConfig, chat *TwitchChat) (*IrcChannel, error) {
 	channel := new(IrcChannel)
 	channel.Name = name
+	channel.Colors = chat.colors
+	if !cfg.SendOnly {
+		channel.History = chat.history
+		channel.Highlights = chat.highlights
+		channel.Filters = chat.filters
+		channel.Whispers = chat.whispers
+	}
 	channel.RawIrcMessages = make(chan *irc.Message, 128)
-	channel.PostToChannel = make(chan []byte, 128)
-	channel.ReadFromChannel = make(chan []byte, 128)
+	channel.PostToChannel = make(chan *OutgoingMsg, 128)
+	channel.ReadFromChannel = make(chan *ChatEvent, 128)
+	channel.RoomState.FollowersOnly = -1
 	channel.Config = cfg
+	channel.done = make(chan struct{})
 
 	err := channel.Connect()
 	if err != nil {
@@ -70,36 +115,60 @@ func CreateIrcChannel(name string, cfg *IrcConfig) (*IrcChannel, error) {
 	go channel.RecvLoop()
 	go channel.Sort()
 	go channel.SendLoop()
+	go channel.Monitor()
 	return channel, err
 }
 
 func (channel *IrcChannel) Connect() error {
-	var err error
-	channel.Conn, err = net.Dial("tcp", channel.Config.Server)
+	conn, err := channel.Config.Server.Dial()
 	if err != nil {
-		return fmt.Errorf("Could not connect to irc server: %s: %s", channel.Config.Server, err)
+		return fmt.Errorf("Could not connect to irc server: %s: %s", channel.Config.Server.Address, err)
 	}
+	channel.sendLock.Lock()
+	channel.Conn = conn
+	channel.sendLock.Unlock()
 	return nil
 }
 
+// Close the current connection, which makes RecvLoop reconnect unless the channel is closed
+func (channel *IrcChannel) closeConn() {
+	channel.sendLock.Lock()
+	defer channel.sendLock.Unlock()
+	channel.Conn.Close()
+}
+
 func (channel *IrcChannel) Login(cfg *IrcConfig) error {
 	messages := []*irc.Message{}
 	//log.Print("Logging into channel: ", channel.Name)
+	// The credentials may be replaced by authChanged while we reconnect
+	channel.sendLock.Lock()
+	username, password := cfg.Username, cfg.Password
+	channel.sendLock.Unlock()
+
+	// Without a token we can still read chat anonymously
+	anonymous := password == ""
+	if anonymous {
+		username = anonymousNick()
+	}
+	channel.stateLock.Lock()
+	channel.Anonymous = anonymous
+	channel.stateLock.Unlock()
+
 	// create necessary login messages
-	if cfg.Password != "" {
+	if !anonymous {
 		messages = append(messages, &irc.Message{
 			Command: irc.PASS,
-			Params:  []string{"oauth:" + cfg.Password},
+			Params:  []string{"oauth:" + password},
 		})
 	}
 	messages = append(messages, &irc.Message{
 		Command: irc.NICK,
-		Params:  []string{cfg.Username},
+		Params:  []string{username},
 	})
 	messages = append(messages, &irc.Message{
 		Command:  irc.USER,
-		Params:   []string{cfg.Username, "0", "*"},
-		Trailing: cfg.Username,
+		Params:   []string{username, "0", "*"},
+		Trailing: username,
 	})
 	// Send login messages
 	var err error
@@ -112,68 +181,150 @@ func (channel *IrcChannel) Login(cfg *IrcConfig) error {
 }
 
 func (channel *IrcChannel) Send(msg *irc.Message) error {
+	channel.sendLock.Lock()
+	defer channel.sendLock.Unlock()
 	err := channel.Writer.Encode(msg)
 	return err
 }
 
-func (channel *IrcChannel) SendChatMsg(msg string) {
-	channel.PostToChannel <- []byte(msg)
+// The rate limits of the account the channel is logged in as, which change with the account
+func (channel *IrcChannel) limits() *ChatLimits {
+	channel.sendLock.Lock()
+	defer channel.sendLock.Unlock()
+	return channel.Config.Limits
+}
+
+// The login the channel is logged in as, which changes with the account
+func (channel *IrcChannel) username() string {
+	channel.sendLock.Lock()
+	defer channel.sendLock.Unlock()
+	return channel.Config.Username
+}
+
+// Queue a message for SendLoop. Messages for a disconnected channel are dropped.
+func (channel *IrcChannel) SendChatMsg(msg *OutgoingMsg) {
+	select {
+	case channel.PostToChannel <- msg:
+	case <-channel.done:
+	}
 }
 
 func (channel *IrcChannel) Reconnect() error {
-	if channel.Config.MaxRetries > 0 {
-		channel.Conn.Close()
-		err := channel.Connect()
-		for err != nil && channel.retries < channel.Config.MaxRetries {
-			log.Print("Reconnecting channel ", channel.Name)
-			duration := time.Duration(math.Pow(2.0, float64(channel.retries))*200) * time.Millisecond
-			time.Sleep(duration)
-			channel.retries++
-		}
-		return err
-	} else {
+	channel.lost()
+	channel.closeConn()
+	err := channel.Connect()
+	for err != nil && channel.retries < channel.Config.MaxRetries {
+		log.Print("Reconnecting channel ", channel.Name)
+		duration := time.Duration(math.Pow(2.0, float64(channel.retries))*200) * time.Millisecond
+		time.Sleep(duration)
+		channel.retries++
+		err = channel.Connect()
+	}
+	if err != nil {
 		log.Print("Out of retries for channel: ", channel.Name)
-		close(channel.RawIrcMessages)
-		close(channel.PostToChannel)
-		close(channel.ReadFromChannel)
+		return err
+	}
+	channel.retries = 0
+
+	channel.sendLock.Lock()
+	channel.Reader = irc.NewDecoder(channel.Conn)
+	channel.Writer = irc.NewEncoder(channel.Conn)
+	channel.sendLock.Unlock()
+	return channel.Login(channel.Config)
+}
+
+// Check if the channel was disconnected on purpose
+func (channel *IrcChannel) isClosed() bool {
+	select {
+	case <-channel.done:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
+
 func (channel *IrcChannel) RecvLoop() {
+	// RecvLoop is the only writer of RawIrcMessages, so it closes it for Sort
+	defer close(channel.RawIrcMessages)
 	for {
-		channel.Conn.SetDeadline(time.Now().Add(300 * time.Second))
+		// The health monitor pings far more often, this only catches it failing
+		channel.Conn.SetDeadline(time.Now().Add(3 * healthInterval))
 		msg, err := channel.Reader.Decode()
 		if err != nil {
-			// TODO: implement reconnect
-			channel.Reconnect()
+			if channel.isClosed() {
+				return
+			}
 			log.Print("Lost connection to chat channel: ", channel.Name, ": ", err)
-			return
+			if err = channel.Reconnect(); err != nil {
+				return
+			}
+			continue
 		}
+		channel.touch()
 		channel.RawIrcMessages <- msg
 	}
 }
 
 func (channel *IrcChannel) Sort() {
+	// Sort closes ReadFromChannel, other goroutines emitting check readClosed first
+	defer func() {
+		channel.emitLock.Lock()
+		channel.readClosed = true
+		close(channel.ReadFromChannel)
+		channel.emitLock.Unlock()
+	}()
 	// Sort and handle irc messages
 	for msg := range channel.RawIrcMessages {
-		if msg.Command == irc.RPL_WELCOME {
+		switch msg.Command {
+		case irc.RPL_WELCOME:
 			channel.handleCAP(msg)
 			channel.handleConnect(msg)
-		} else if msg.Command == irc.PING {
+		case irc.PING:
 			channel.handlePing(msg)
-		} else if msg.Command == irc.PRIVMSG {
+		case irc.PONG:
+			channel.handlePong(msg)
+		case irc.PRIVMSG:
 			//fmt.Println(msg.Params, ":", msg.Trailing)
 			channel.handlePrivMsg(msg)
+		case "USERNOTICE":
+			channel.handleUserNotice(msg)
+		case "CLEARCHAT":
+			channel.handleClearChat(msg)
+		case "CLEARMSG":
+			channel.handleClearMsg(msg)
+		case "ROOMSTATE":
+			channel.handleRoomState(msg)
+		case "USERSTATE":
+			channel.handleUserState(msg)
+		case "GLOBALUSERSTATE":
+			channel.handleGlobalUserState(msg)
+		case irc.NOTICE:
+			channel.handleNotice(msg)
+		case "HOSTTARGET":
+			channel.handleHostTarget(msg)
+		case "RECONNECT":
+			channel.handleReconnect(msg)
+		case "WHISPER":
+			channel.handleWhisper(msg)
 		}
-		// Catch USERSTATE on join
 	}
 }
 
+// Join once the join limit allows, without holding up Sort which has to keep answering PINGs
 func (channel *IrcChannel) handleConnect(m *irc.Message) {
-	channel.Send(&irc.Message{
-		Command: irc.JOIN,
-		Params:  []string{channel.Name},
-	})
+	limits := channel.limits()
+	go func() {
+		limits.WaitJoin()
+		select {
+		case <-channel.done:
+			return
+		default:
+		}
+		channel.Send(&irc.Message{
+			Command: irc.JOIN,
+			Params:  []string{channel.Name},
+		})
+	}()
 }
 
 func (channel *IrcChannel) handleCAP(m *irc.Message) {
@@ -230,71 +381,68 @@ func (channel *IrcChannel) handlePrivMsg(msg *irc.Message) {
 	fmt_msg.disp_name = reDisp.FindStringSubmatch(fmt_msg.raw)
 
 	// Parse color tag
-	reColor, err := regexp.Compile(`#[[:xdigit:]]{6}`)
+	reColor, err := regexp.Compile(`color\=(#[[:xdigit:]]{6})(\;|\s)`)
 	if err != nil {
 		log.Print("Could not parse Color\n")
 	}
 	fmt_msg.color = reColor.FindStringSubmatch(fmt_msg.raw)
 
-	if len(fmt_msg.color) == 1 && len(fmt_msg.disp_name) >= 1 && len(fmt_msg.sub) >= 1 && len(fmt_msg.turbo) >= 1 && len(fmt_msg.usertype) >= 1 {
+	// Parse user id, used to give users without a color a stable one
+	reUserId, err := regexp.Compile(`user-id\=(.*?)(\;|\s)`)
+	if err != nil {
+		log.Print("Could not parse UserId\n")
+	}
+	userId := ""
+	if match := reUserId.FindStringSubmatch(fmt_msg.raw); len(match) > 1 {
+		userId = match[1]
+	}
+
+	login := ""
+	if msg.Prefix != nil {
+		login = msg.Prefix.Name
+	}
+	tagColor := ""
+	if len(fmt_msg.color) > 1 {
+		tagColor = fmt_msg.color[1]
+	}
+	color := channel.Colors.Color(userId, login, tagColor)
+
+	// Ignored users and filtered messages never reach the frontend
+	text := msg.Trailing
+	if channel.Filters != nil {
+		var show bool
+		if text, show = channel.Filters.Apply(login, userId, text); !show {
+			return
+		}
+	}
+
+	var line string
+	if len(fmt_msg.disp_name) > 1 && fmt_msg.disp_name[1] != "" && len(fmt_msg.sub) > 1 && len(fmt_msg.turbo) > 1 && len(fmt_msg.usertype) > 1 {
 		// User has all fields (mod or staff)
 		// <a href='https://www.twitch.tv/" + msg.Prefix.Name + "/profile' target='_blank'><strong>" + fmt_msg.disp_name[1] + "</strong></a>
-		channel.ReadFromChannel <- []byte("<span data-usertype='" + fmt_msg.usertype[1] + "' data-sub='" + fmt_msg.sub[1] + "' data-turbo='" + fmt_msg.turbo[1] + 
-		"' style='color:" + fmt_msg.color[0] + "' id='username'><strong>" + fmt_msg.disp_name[1] + "</strong></span><span id='text'>: " + html.EscapeString(msg.Trailing) + " </span>")
-	} else if len(fmt_msg.color) == 1 && len(fmt_msg.disp_name) >= 1 && len(fmt_msg.sub) >= 1 && len(fmt_msg.turbo) >= 1 {
+		line = "<span data-usertype='" + fmt_msg.usertype[1] + "' data-sub='" + fmt_msg.sub[1] + "' data-turbo='" + fmt_msg.turbo[1] +
+			"' style='color:" + color + "' id='username'><strong>" + fmt_msg.disp_name[1] + "</strong></span><span id='text'>: " + html.EscapeString(text) + " </span>"
+	} else if len(fmt_msg.disp_name) > 1 && fmt_msg.disp_name[1] != "" && len(fmt_msg.sub) > 1 && len(fmt_msg.turbo) > 1 {
 		// User is missing user-type tag (non-mod)
-		channel.ReadFromChannel <- []byte("<span data-sub='" + fmt_msg.sub[1] + "' data-turbo='" + fmt_msg.turbo[1] + "' style='color:" + fmt_msg.color[0] + 
-		"' id='username'><strong>" + fmt_msg.disp_name[1] + "</strong></span><span id='text'>: " + html.EscapeString(msg.Trailing) + " </span>")
-	} else if len(fmt_msg.color) == 1 && len(fmt_msg.disp_name) >= 1 {
+		line = "<span data-sub='" + fmt_msg.sub[1] + "' data-turbo='" + fmt_msg.turbo[1] + "' style='color:" + color +
+			"' id='username'><strong>" + fmt_msg.disp_name[1] + "</strong></span><span id='text'>: " + html.EscapeString(text) + " </span>"
+	} else if len(fmt_msg.disp_name) > 1 && fmt_msg.disp_name[1] != "" {
 		// User is missing user-type, subscriber, and turbo tags (rare)
-		channel.ReadFromChannel <- []byte("<span data-sub='0' data-turbo='0' style='color:" + fmt_msg.color[0] + 
-		"' id='username'><strong>" + fmt_msg.disp_name[1] + "</strong></span><span id='text'>: " + html.EscapeString(msg.Trailing) + " </span>")
-	} else if len(fmt_msg.color) == 1 {
-		// User is bot (or not authenticated)
-		channel.ReadFromChannel <- []byte("<span style='color:" + fmt_msg.color[0] + "' id='username'><strong>" + msg.Prefix.Name + "</strong></span><span id='text'>: " + html.EscapeString(msg.Trailing) + " </span>")
+		line = "<span data-sub='0' data-turbo='0' style='color:" + color +
+			"' id='username'><strong>" + fmt_msg.disp_name[1] + "</strong></span><span id='text'>: " + html.EscapeString(text) + " </span>"
 	} else {
-		// Randomize colors if the user has never set them before
-		rand.Seed(time.Now().UTC().UnixNano())
-		colors := []string{
-			"#FF0000",
-			"#0000FF",
-			"#008000",
-			"#B22222",
-			"#FF7F50",
-			"#9ACD32",
-			"#FF4500",
-			"#2E8B57",
-			"#DAA520",
-			"#D2691E",
-			"#5F9EA0",
-			"#1E90FF",
-			"#FF69B4",
-			"#8A2BE2",
-			"#00FF7F",
-		}
-
-		/* Map colors to the name, broken for some reason
-		color, ok := fmt_msg.colorMap[msg.Prefix.Name]
-		if !ok {
-			color = colors[rand.Intn(len(colors))]
-			fmt_msg.colorMap[msg.Prefix.Name] = color
-		}*/
-
-		color := colors[rand.Intn(len(colors))]
+		// User is bot (or not authenticated)
+		line = "<span style='color:" + color + "' id='username'><strong>" + login + "</strong></span><span id='text'>: " + html.EscapeString(text) + " </span>"
+	}
 
-		if len(fmt_msg.disp_name) >= 1 && len(fmt_msg.sub) >= 1 && len(fmt_msg.turbo) >= 1 && len(fmt_msg.usertype) >= 1 {
-			// User has all fields (mod or staff)
-			channel.ReadFromChannel <- []byte("<span data-usertype='" + fmt_msg.usertype[1] + "' data-sub='" + fmt_msg.sub[1] + "' data-turbo='" + fmt_msg.turbo[1] + 
-			"' style='color:" + color + "' id='username'><strong>" + fmt_msg.disp_name[1] + "</strong></span><span id='text'>: " + html.EscapeString(msg.Trailing) + " </span>")
-		} else if len(fmt_msg.disp_name) >= 1 && len(fmt_msg.sub) >= 1 && len(fmt_msg.turbo) >= 1 {
-			// User is missing user-type tag (non-mod)
-			channel.ReadFromChannel <- []byte("<span data-sub='" + fmt_msg.sub[1] + "' data-turbo='" + fmt_msg.turbo[1] + "' style='color:" + color + 
-			"' id='username'><strong>" + fmt_msg.disp_name[1] + "</strong></span><span id='text'>: " + html.EscapeString(msg.Trailing) + " </span>")
-		} else if len(fmt_msg.disp_name) >= 1 {
-			// User is missing user-type, subscriber, and turbo tags (rare)
-			channel.ReadFromChannel <- []byte("<span data-sub='0' data-turbo='0' style='color:" + color + 
-			"' id='username'><strong>" + fmt_msg.disp_name[1] + "</strong></span><span id='text'>: " + html.EscapeString(msg.Trailing) + " </span>")
-		}
+	ev := channel.newEvent(EventPrivMsg, msg)
+	ev.User = login
+	ev.Text = text
+	ev.Html = line
+	notification := channel.highlight(ev)
+	channel.emit(ev)
+	if notification != nil {
+		channel.emit(notification)
 	}
 }
 
@@ -307,20 +455,42 @@ func (channel *IrcChannel) handlePing(msg *irc.Message) {
 }
 
 func (channel *IrcChannel) SendLoop() {
-	for msg := range channel.PostToChannel {
-		channel.Send(&irc.Message{
+	for {
+		var msg *OutgoingMsg
+		select {
+		case msg = <-channel.PostToChannel:
+		case <-channel.done:
+			return
+		}
+		channel.limits().WaitSend(channel.isModerator())
+		text := channel.outgoingText(msg)
+		// Twitch may answer before Send returns, so the answer must find the message
+		if !msg.Command {
+			channel.addPending(msg)
+		}
+		err := channel.Send(&irc.Message{
 			Command:  "PRIVMSG",
 			Params:   []string{channel.Name},
-			Trailing: string(msg),
+			Trailing: text,
 		})
+		if err != nil {
+			if !msg.Command {
+				channel.removePending(msg)
+			}
+			channel.emitSendFailed(msg, "send_error", err.Error())
+		}
+		channel.emitQueueDepth()
 	}
 }
 
+// Close the connection for good. PostToChannel stays open, senders may still
+// hold it; SendLoop stops once done is closed.
 func (channel *IrcChannel) Disconnect() {
-	close(channel.PostToChannel)
-	close(channel.ReadFromChannel)
-	close(channel.RawIrcMessages)
-	channel.Conn.Close()
+	channel.disconnect.Do(func() {
+		// RecvLoop and Sort close the remaining channels once the connection is gone
+		close(channel.done)
+		channel.closeConn()
+	})
 }
 
 type wsHandler struct {
@@ -336,46 +506,194 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// Switch chat to a single channel, leaving every other channel
 func (chat *TwitchChat) AddChannel(user string, channel string, pass string) *IrcChannel {
-	config := &IrcConfig{
-		Server:	    "irc.chat.twitch.tv:80",
-		Username:   user,
-		Password:   pass,
-		MaxRetries: 3,
-	}
-	ircchannel, err := CreateIrcChannel(channel, config)
-	if err != nil {
-		log.Print("Could not connect to channel: ", channel, ": ", err)
+	ircchannel := chat.connectChannel(user, channel, pass)
+	if ircchannel == nil {
 		return nil
 	}
+
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
 	for _, oldchan := range chat.channels {
 		oldchan.Disconnect()
 	}
+	chat.dropSenders("", "")
 	chat.channels = chat.channels[:0]
 	chat.channels = append(chat.channels, ircchannel)
-	chat.curIn = ircchannel.PostToChannel
-	chat.curOut = ircchannel.ReadFromChannel
+	chat.setCurrent(ircchannel)
 	//fmt.Println("Added new chat channel")
 	return ircchannel
 }
 
+// Join a channel in addition to the ones we are already in, and make it the current one
+func (chat *TwitchChat) JoinChannel(user string, channel string, pass string) *IrcChannel {
+	ircchannel := chat.connectChannel(user, channel, pass)
+	if ircchannel == nil {
+		return nil
+	}
+
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	chat.channels = append(chat.channels, ircchannel)
+	chat.setCurrent(ircchannel)
+	return ircchannel
+}
+
+// Leave a channel, the last joined remaining channel becomes the current one
+func (chat *TwitchChat) PartChannel(channel string) bool {
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	for i, ircchannel := range chat.channels {
+		if ircchannel.Name != channel {
+			continue
+		}
+		ircchannel.Disconnect()
+		chat.dropSenders("", channel)
+		chat.channels = append(chat.channels[:i], chat.channels[i+1:]...)
+		if chat.current == ircchannel {
+			chat.current = nil
+			if len(chat.channels) > 0 {
+				chat.setCurrent(chat.channels[len(chat.channels)-1])
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// List the channels we are currently in
+func (chat *TwitchChat) Channels() []*IrcChannel {
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	return append([]*IrcChannel(nil), chat.channels...)
+}
+
+// The channel messages typed into the chat box are sent to
+func (chat *TwitchChat) Current() *IrcChannel {
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	return chat.current
+}
+
+// Number of events replayed to a new websocket client
+func (chat *TwitchChat) replayCount() int {
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	return chat.replay
+}
+
+func (chat *TwitchChat) SetReplay(count int) {
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	chat.replay = count
+}
+
+func (chat *TwitchChat) setCurrent(ircchannel *IrcChannel) {
+	chat.current = ircchannel
+}
+
+func (chat *TwitchChat) connectChannel(user string, channel string, pass string) *IrcChannel {
+	server := chat.server
+	if server == nil {
+		server, _ = NewChatServer("", "", "", false)
+	}
+	config := &IrcConfig{
+		Server:     server,
+		Username:   user,
+		Password:   pass,
+		MaxRetries: chat.maxRetries,
+		Limits:     chat.limitsOf(chat.Auth()),
+	}
+	ircchannel, err := CreateIrcChannel(channel, config, chat)
+	if err != nil {
+		log.Print("Could not connect to channel: ", channel, ": ", err)
+		return nil
+	}
+	go chat.pump(ircchannel)
+	return ircchannel
+}
+
+// Send a line typed into the chat box, running it as a command if it starts with a slash
+func (chat *TwitchChat) Submit(out *OutgoingMsg) {
+	channel := chat.Current()
+	if strings.HasPrefix(out.Text, "/") {
+		cmd, args, err := chat.commands.Parse(out.Text)
+		if err == nil && channel == nil && !cmd.Local {
+			err = fmt.Errorf("Not in a channel, use /join <channel> first")
+		} else if err == nil && !cmd.Local {
+			err = chat.sendError(channel, "chat:edit")
+		}
+		if err == nil {
+			err = cmd.Run(chat, channel, args)
+		}
+		if err != nil {
+			chat.reply(channel, EventCommandError, err.Error())
+		}
+		return
+	}
+
+	if channel == nil {
+		log.Print("Dropping chat message, not in a channel")
+		return
+	}
+	if err := chat.sendError(channel, "chat:edit"); err != nil {
+		chat.reply(channel, EventCommandError, err.Error())
+		return
+	}
+	channel.SendChatMsg(out)
+}
+
+// Answer a command typed into the chat box
+func (chat *TwitchChat) reply(channel *IrcChannel, eventType string, text string) {
+	if channel == nil {
+		chat.hub.Broadcast(&ChatEvent{Type: eventType, Time: time.Now(), Text: text})
+		return
+	}
+	ev := channel.newEvent(eventType, nil)
+	ev.Text = text
+	channel.emit(ev)
+}
+
 // Accept incomming connections
 func (handle wsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	conn, err := upgrader.Upgrade(w, req, nil) // omit the responseHeader http.Header for now, not needed
 	//fmt.Print("Got a connection\n")
 	if err != nil {
 		log.Print("Could not open websocket:", err)
+		return
+	}
+
+	// Clients may only want some channels: /ws?channel=#foo&channel=#bar
+	channels := req.URL.Query()["channel"]
+	sub := handle.chat.hub.Subscribe(channels)
+
+	// Let the client know if it may send messages before anything else
+	conn.WriteMessage(websocket.TextMessage, handle.chat.sessionEvent().Bytes())
+
+	// Replay what was said before the client connected
+	if len(channels) == 0 {
+		if channel := handle.chat.Current(); channel != nil {
+			channels = []string{channel.Name}
+		}
 	}
+	for _, channel := range channels {
+		for _, ev := range handle.chat.history.Recent(channelName(channel), handle.chat.replayCount()) {
+			conn.WriteMessage(websocket.TextMessage, ev.Bytes())
+		}
+	}
+
 	//log.Print("Started websocket for chat")
-	go handle.chat.SendToClient(conn)
+	go handle.chat.SendToClient(conn, sub)
 	handle.chat.RecvFromClient(conn)
+	handle.chat.hub.Unsubscribe(sub)
 }
 
 // Write messages from twitch's server to the websocket
-func (chat *TwitchChat) SendToClient(conn *websocket.Conn) {
-	for msg := range chat.curOut {
+func (chat *TwitchChat) SendToClient(conn *websocket.Conn, sub *ChatSubscriber) {
+	for msg := range sub.Events {
 		//log.Print("Sending to client: ", string(msg))
-		err := conn.WriteMessage(websocket.TextMessage, []byte(string(msg)))
+		err := conn.WriteMessage(websocket.TextMessage, msg.Bytes())
 
 		if err != nil {
 			break
@@ -430,9 +748,8 @@ func (chat *TwitchChat) RecvFromClient(conn *websocket.Conn) {
 		if err != nil {
 			break
 		}
-		arr := []byte(chat.auth.Username + ": ")
-		chat.curIn <- msg
-		chat.curOut <- []byte(string((append(arr[:], msg[:]...))))
+		// The message is echoed back once twitch acknowledges it
+		chat.Submit(NewOutgoingMsg(msg))
 	}
 	conn.Close()
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The auth of the account chat is logged in as, which changes when switching accounts
+func (chat *TwitchChat) Auth() Auth {
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	return chat.auth
+}
+
+// Log every channel in as another account after switching to it.
+// The channels keep their clients and history, only the irc connections are replaced.
+func (chat *TwitchChat) SetAuth(auth Auth) {
+	chat.lock.Lock()
+	chat.auth = auth
+	// Connections the account had for sending are covered by the main ones now
+	chat.dropSenders("", "")
+	chat.lock.Unlock()
+
+	chat.authChanged(auth)
+}
+
+// The rate limits of the account an auth belongs to. Connections which are
+// not logged in as any account, like those of tests, share chat's own.
+func (chat *TwitchChat) limitsOf(auth Auth) *ChatLimits {
+	if chat.accounts != nil {
+		for _, name := range chat.accounts.Names() {
+			if account := chat.accounts.Get(name); account.Auth == auth {
+				return account.Limits
+			}
+		}
+	}
+	return chat.limits
+}
+
+// Find a channel we are in by name
+func (chat *TwitchChat) channel(name string) *IrcChannel {
+	for _, channel := range chat.Channels() {
+		if channel.Name == name {
+			return channel
+		}
+	}
+	return nil
+}
+
+// Send a message as an account to a channel we are in, the current one when
+// name is empty. Accounts other than the active one get a connection of their
+// own to the channel, which only reports whether twitch accepted the message:
+// the main connection receives it like anyone else's.
+func (chat *TwitchChat) SendAs(account *Account, name string, out *OutgoingMsg) error {
+	channel := chat.Current()
+	if name != "" {
+		channel = chat.channel(channelName(name))
+	}
+	if channel == nil && name != "" {
+		return fmt.Errorf("Not in channel %s", channelName(name))
+	} else if channel == nil {
+		return fmt.Errorf("Not in a channel, use /join <channel> first")
+	}
+	if strings.TrimSpace(out.Text) == "" {
+		return fmt.Errorf("Nothing to send")
+	}
+
+	if account.Auth == chat.Auth() {
+		if err := chat.sendError(channel, "chat:edit"); err != nil {
+			return err
+		}
+		channel.SendChatMsg(out)
+		return nil
+	}
+	if account.Auth.Token() == "" {
+		return fmt.Errorf("The %s account is not logged in", account.Name)
+	}
+	if !account.Auth.HasScope("chat:edit") {
+		return fmt.Errorf("The %s account's token is missing the chat:edit scope, log in again to use it", account.Name)
+	}
+	sender, err := chat.sender(account, channel.Name)
+	if err != nil {
+		return err
+	}
+	sender.SendChatMsg(out)
+	return nil
+}
+
+// Key of the connection sending as an account to a channel
+func senderKey(account string, channel string) string {
+	return account + " " + channel
+}
+
+// The connection sending as an account to a channel, connecting it the first time
+func (chat *TwitchChat) sender(account *Account, name string) (*IrcChannel, error) {
+	key := senderKey(account.Name, name)
+	chat.lock.Lock()
+	sender := chat.senders[key]
+	chat.lock.Unlock()
+	if sender != nil {
+		return sender, nil
+	}
+
+	server := chat.server
+	if server == nil {
+		server, _ = NewChatServer("", "", "", false)
+	}
+	config := &IrcConfig{
+		Server:     server,
+		Username:   account.Auth.User(),
+		Password:   account.Auth.Token(),
+		MaxRetries: chat.maxRetries,
+		Limits:     account.Limits,
+		SendOnly:   true,
+	}
+	sender, err := CreateIrcChannel(name, config, chat)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %s as %s: %s", name, account.Name, err)
+	}
+	go chat.pump(sender)
+
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	if existing := chat.senders[key]; existing != nil {
+		// Another message connected first
+		sender.Disconnect()
+		return existing, nil
+	}
+	if chat.senders == nil {
+		chat.senders = make(map[string]*IrcChannel)
+	}
+	chat.senders[key] = sender
+	return sender, nil
+}
+
+// Disconnect the sending connections of an account, such as after it logged out
+func (chat *TwitchChat) closeSenders(account string) {
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	chat.dropSenders(account, "")
+}
+
+// Disconnect the sending connections of an account to a channel, an empty
+// account or channel matching all of them. The chat lock must be held.
+func (chat *TwitchChat) dropSenders(account string, channel string) {
+	for key, sender := range chat.senders {
+		if account != "" && !strings.HasPrefix(key, account+" ") {
+			continue
+		}
+		if channel != "" && sender.Name != channel {
+			continue
+		}
+		sender.Disconnect()
+		delete(chat.senders, key)
+	}
+}
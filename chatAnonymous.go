@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Sent to websocket clients when they connect and whenever sending becomes possible
+const EventSession = "session"
+
+// Twitch lets anyone read chat as justinfan followed by a number, without a password
+func anonymousNick() string {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return fmt.Sprintf("justinfan%d", 1000+random.Intn(80000))
+}
+
+// Error returned when trying to send over an anonymous connection
+var errReadOnly = fmt.Errorf("Chat is read-only until you log in to twitch")
+
+// Check if the channel is logged in as justinfan
+func (channel *IrcChannel) isAnonymous() bool {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
+	return channel.Anonymous
+}
+
+// Check if messages can be sent, anonymous logins can only read
+func (chat *TwitchChat) CanSend() bool {
+	auth := chat.Auth()
+	return auth != nil && auth.Token() != "" && auth.HasScope("chat:edit")
+}
+
+// Explain why a channel cannot be used for something needing a scope, nil if it can
+func (chat *TwitchChat) sendError(channel *IrcChannel, scope string) error {
+	if channel.isAnonymous() {
+		return errReadOnly
+	}
+	if auth := chat.Auth(); auth != nil && !auth.HasScope(scope) {
+		return fmt.Errorf("The auth token is missing the %s scope, log in again to use it", scope)
+	}
+	return nil
+}
+
+// Event telling clients whether they may send messages
+func (chat *TwitchChat) sessionEvent() *ChatEvent {
+	canSend := chat.CanSend()
+	ev := &ChatEvent{Type: EventSession, Time: time.Now(), CanSend: &canSend}
+	if canSend {
+		ev.User = chat.Auth().User()
+	}
+	return ev
+}
+
+// Follow the credentials of the account chat is logged in as. Channels keep a
+// refreshed token for their next login, and log in again right away when who
+// they are logged in as changes, such as once a token arrives for anonymous
+// channels. The channels keep their clients and history, only the irc
+// connection is replaced.
+func (chat *TwitchChat) authChanged(auth Auth) {
+	if chat.Auth() != auth {
+		return
+	}
+	user, pass := auth.User(), auth.Token()
+	// Validating a new token tells who it belongs to, which chat waits for
+	if pass != "" && user == "" {
+		return
+	}
+	limits := chat.limitsOf(auth)
+	for _, channel := range chat.Channels() {
+		channel.sendLock.Lock()
+		relogin := channel.Config.Username != user || (channel.Config.Password == "") != (pass == "")
+		channel.Config.Username = user
+		channel.Config.Password = pass
+		if limits != nil {
+			channel.Config.Limits = limits
+		}
+		channel.sendLock.Unlock()
+		if relogin {
+			log.Print("Logging into chat channel ", channel.Name, " as ", user)
+			// RecvLoop notices the closed connection and logs in again with the new credentials
+			channel.closeConn()
+		}
+	}
+	chat.hub.Broadcast(chat.sessionEvent())
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Twitch's default palette, used for users who never picked a color
+var defaultChatColors = []string{
+	"#FF0000",
+	"#0000FF",
+	"#008000",
+	"#B22222",
+	"#FF7F50",
+	"#9ACD32",
+	"#FF4500",
+	"#2E8B57",
+	"#DAA520",
+	"#D2691E",
+	"#5F9EA0",
+	"#1E90FF",
+	"#FF69B4",
+	"#8A2BE2",
+	"#00FF7F",
+}
+
+// How usernames should be recolored to stay readable on the frontend's theme
+type ColorMode int
+
+const (
+	ColorModeNone  ColorMode = iota // Use colors as sent by twitch
+	ColorModeDark                   // Lighten colors for a dark background
+	ColorModeLight                  // Darken colors for a light background
+)
+
+// Background colors the contrast correction is computed against
+const (
+	darkBackground  = "#18181B"
+	lightBackground = "#FFFFFF"
+	minContrast     = 4.5
+)
+
+// Parse a color mode as written in the config file
+func ParseColorMode(mode string) (ColorMode, error) {
+	switch strings.ToLower(mode) {
+	case "", "none":
+		return ColorModeNone, nil
+	case "dark":
+		return ColorModeDark, nil
+	case "light":
+		return ColorModeLight, nil
+	}
+	return ColorModeNone, fmt.Errorf("Unknown color mode: %s", mode)
+}
+
+// Bounded LRU of the colors assigned to chat users
+type ColorCache struct {
+	mode    ColorMode
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	lock    sync.Mutex
+}
+
+type colorEntry struct {
+	key   string
+	color string
+}
+
+// Create a color cache holding at most size users
+func NewColorCache(size int) *ColorCache {
+	cache := new(ColorCache)
+	cache.size = size
+	cache.order = list.New()
+	cache.entries = make(map[string]*list.Element)
+	return cache
+}
+
+// Change the contrast correction mode, forgetting every color computed with the old one
+func (cache *ColorCache) SetMode(mode ColorMode) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.mode = mode
+	cache.order.Init()
+	cache.entries = make(map[string]*list.Element)
+}
+
+// Return the color to display for a user. tagColor is the color tag twitch
+// sent with the message and may be empty, in which case a fallback is derived
+// from the user id (or the login if twitch did not send an id).
+func (cache *ColorCache) Color(userId string, login string, tagColor string) string {
+	key := userId
+	if key == "" {
+		key = strings.ToLower(login)
+	}
+	key += "|" + strings.ToUpper(tagColor)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if elem, ok := cache.entries[key]; ok {
+		cache.order.MoveToFront(elem)
+		return elem.Value.(*colorEntry).color
+	}
+
+	color := tagColor
+	if color == "" {
+		color = fallbackColor(userId, login)
+	}
+	color = adjustColor(color, cache.mode)
+
+	cache.entries[key] = cache.order.PushFront(&colorEntry{key: key, color: color})
+	for cache.size > 0 && cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*colorEntry).key)
+	}
+	return color
+}
+
+// Pick a stable color from the default palette for a user without a color
+func fallbackColor(userId string, login string) string {
+	key := userId
+	if key == "" {
+		key = strings.ToLower(login)
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return defaultChatColors[hash.Sum32()%uint32(len(defaultChatColors))]
+}
+
+// Lighten or darken a color until it is readable on the mode's background
+func adjustColor(color string, mode ColorMode) string {
+	if mode == ColorModeNone {
+		return color
+	}
+	r, g, b, err := parseHexColor(color)
+	if err != nil {
+		return color
+	}
+
+	background := darkBackground
+	step := 0.05
+	if mode == ColorModeLight {
+		background = lightBackground
+		step = -0.05
+	}
+	br, bg, bb, _ := parseHexColor(background)
+	bgLum := luminance(br, bg, bb)
+
+	h, s, l := rgbToHsl(r, g, b)
+	for contrast(luminance(r, g, b), bgLum) < minContrast {
+		l += step
+		if l < 0 || l > 1 {
+			break
+		}
+		r, g, b = hslToRgb(h, s, l)
+	}
+	return fmt.Sprintf("#%02X%02X%02X", int(math.Round(r*255)), int(math.Round(g*255)), int(math.Round(b*255)))
+}
+
+// Parse a #RRGGBB color into components in the 0-1 range
+func parseHexColor(color string) (float64, float64, float64, error) {
+	if len(color) != 7 || color[0] != '#' {
+		return 0, 0, 0, fmt.Errorf("Invalid color: %s", color)
+	}
+	value, err := strconv.ParseUint(color[1:], 16, 32)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Invalid color: %s", color)
+	}
+	return float64(value>>16&0xFF) / 255, float64(value>>8&0xFF) / 255, float64(value&0xFF) / 255, nil
+}
+
+// Relative luminance as defined by WCAG
+func luminance(r, g, b float64) float64 {
+	channel := func(c float64) float64 {
+		if c <= 0.03928 {
+			return c / 12.92
+		}
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+	return 0.2126*channel(r) + 0.7152*channel(g) + 0.0722*channel(b)
+}
+
+// WCAG contrast ratio between two luminances
+func contrast(a, b float64) float64 {
+	if a < b {
+		a, b = b, a
+	}
+	return (a + 0.05) / (b + 0.05)
+}
+
+func rgbToHsl(r, g, b float64) (float64, float64, float64) {
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	l := (max + min) / 2
+	if max == min {
+		return 0, 0, l
+	}
+
+	d := max - min
+	s := d / (1 - math.Abs(2*l-1))
+	var h float64
+	switch max {
+	case r:
+		h = math.Mod((g-b)/d, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h, s, l
+}
+
+func hslToRgb(h, s, l float64) (float64, float64, float64) {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return r + m, g + m, b + m
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChatColors(t *testing.T) {
+	Convey("Test fallback colors for users without a color tag", t, func() {
+		cache := NewColorCache(2)
+
+		Convey("The same user always gets the same color", func() {
+			first := cache.Color("12345", "someone", "")
+			So(cache.Color("12345", "someone", ""), ShouldEqual, first)
+			So(defaultChatColors, ShouldContain, first)
+		})
+		Convey("The color survives being evicted from the cache", func() {
+			first := cache.Color("12345", "someone", "")
+			cache.Color("1", "a", "")
+			cache.Color("2", "b", "")
+			So(cache.Color("12345", "someone", ""), ShouldEqual, first)
+		})
+		Convey("A color tag sent by twitch wins", func() {
+			So(cache.Color("12345", "someone", "#123456"), ShouldEqual, "#123456")
+		})
+	})
+
+	Convey("Test contrast correction", t, func() {
+		Convey("Dark colors are lightened for dark themes", func() {
+			r, g, b, _ := parseHexColor(adjustColor("#0000FF", ColorModeDark))
+			br, bg, bb, _ := parseHexColor(darkBackground)
+			So(contrast(luminance(r, g, b), luminance(br, bg, bb)), ShouldBeGreaterThanOrEqualTo, minContrast)
+		})
+		Convey("Light colors are darkened for light themes", func() {
+			r, g, b, _ := parseHexColor(adjustColor("#00FF7F", ColorModeLight))
+			So(contrast(luminance(r, g, b), 1), ShouldBeGreaterThanOrEqualTo, minContrast)
+		})
+		Convey("Colors are left alone without a mode", func() {
+			So(adjustColor("#0000FF", ColorModeNone), ShouldEqual, "#0000FF")
+		})
+	})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A slash command typed into the chat box
+type ChatCommand struct {
+	Name    string
+	Usage   string
+	MinArgs int
+	MaxArgs int
+	Rest    bool // The last argument runs to the end of the line
+	Local   bool // Local commands work without being in a channel and send no chat message
+	Run     func(chat *TwitchChat, channel *IrcChannel, args []string) error
+}
+
+// Registry of the slash commands understood by the chat box
+type ChatCommands struct {
+	commands map[string]*ChatCommand
+}
+
+// Create a registry holding the built-in commands
+func NewChatCommands() *ChatCommands {
+	registry := new(ChatCommands)
+	registry.commands = make(map[string]*ChatCommand)
+
+	// Commands which twitch implements itself, passed along as a message
+	registry.Register(twitchCommand("timeout", "/timeout <user> [duration] [reason]", 1, 3, true, validateTimeout))
+	registry.Register(twitchCommand("untimeout", "/untimeout <user>", 1, 1, false, nil))
+	registry.Register(twitchCommand("ban", "/ban <user> [reason]", 1, 2, true, nil))
+	registry.Register(twitchCommand("unban", "/unban <user>", 1, 1, false, nil))
+	registry.Register(twitchCommand("slow", "/slow [seconds]", 0, 1, false, validateSeconds(0)))
+	registry.Register(twitchCommand("slowoff", "/slowoff", 0, 0, false, nil))
+	registry.Register(twitchCommand("subscribers", "/subscribers", 0, 0, false, nil))
+	registry.Register(twitchCommand("subscribersoff", "/subscribersoff", 0, 0, false, nil))
+	registry.Register(twitchCommand("emoteonly", "/emoteonly", 0, 0, false, nil))
+	registry.Register(twitchCommand("emoteonlyoff", "/emoteonlyoff", 0, 0, false, nil))
+	registry.Register(twitchCommand("followers", "/followers [duration]", 0, 1, false, nil))
+	registry.Register(twitchCommand("followersoff", "/followersoff", 0, 0, false, nil))
+	registry.Register(twitchCommand("r9kbeta", "/r9kbeta", 0, 0, false, nil))
+	registry.Register(twitchCommand("r9kbetaoff", "/r9kbetaoff", 0, 0, false, nil))
+	registry.Register(twitchCommand("clear", "/clear", 0, 0, false, nil))
+	registry.Register(twitchCommand("mods", "/mods", 0, 0, false, nil))
+	registry.Register(twitchCommand("mod", "/mod <user>", 1, 1, false, nil))
+	registry.Register(twitchCommand("unmod", "/unmod <user>", 1, 1, false, nil))
+	registry.Register(twitchCommand("color", "/color <color>", 1, 1, false, nil))
+	registry.Register(twitchCommand("host", "/host <channel>", 1, 1, false, nil))
+	registry.Register(twitchCommand("unhost", "/unhost", 0, 0, false, nil))
+	registry.Register(twitchCommand("commercial", "/commercial [seconds]", 0, 1, false, validateSeconds(0)))
+
+	// Commands with their own irc representation
+	registry.Register(&ChatCommand{
+		Name:    "me",
+		Usage:   "/me <message>",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Rest:    true,
+		Run: func(chat *TwitchChat, channel *IrcChannel, args []string) error {
+			out := newOutgoingText(args[0])
+			out.Action = true
+			channel.SendChatMsg(out)
+			return nil
+		},
+	})
+
+	// Commands handled by twicciand itself
+	registry.Register(&ChatCommand{
+		Name:    "w",
+		Usage:   "/w <user> <message>",
+		MinArgs: 2,
+		MaxArgs: 2,
+		Rest:    true,
+		Local:   true,
+		Run: func(chat *TwitchChat, channel *IrcChannel, args []string) error {
+			return chat.Whisper(args[0], args[1])
+		},
+	})
+	registry.Register(&ChatCommand{
+		Name:    "as",
+		Usage:   "/as <account> <message>",
+		MinArgs: 2,
+		MaxArgs: 2,
+		Rest:    true,
+		Local:   true,
+		Run: func(chat *TwitchChat, channel *IrcChannel, args []string) error {
+			if chat.accounts == nil || chat.accounts.Get(args[0]) == nil {
+				return fmt.Errorf("Unknown account: %s", args[0])
+			}
+			out := newOutgoingText(args[1])
+			// Twitch does not acknowledge commands, so none is waited for
+			out.Command = strings.HasPrefix(out.Text, "/")
+			return chat.SendAs(chat.accounts.Get(args[0]), "", out)
+		},
+	})
+	registry.Register(&ChatCommand{
+		Name:    "join",
+		Usage:   "/join <channel>",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Local:   true,
+		Run: func(chat *TwitchChat, channel *IrcChannel, args []string) error {
+			auth := chat.Auth()
+			if chat.JoinChannel(auth.User(), channelName(args[0]), auth.Token()) == nil {
+				return fmt.Errorf("Could not join %s", channelName(args[0]))
+			}
+			return nil
+		},
+	})
+	registry.Register(&ChatCommand{
+		Name:    "part",
+		Usage:   "/part [channel]",
+		MinArgs: 0,
+		MaxArgs: 1,
+		Local:   true,
+		Run: func(chat *TwitchChat, channel *IrcChannel, args []string) error {
+			var name string
+			if len(args) > 0 {
+				name = channelName(args[0])
+			} else if channel != nil {
+				name = channel.Name
+			} else {
+				return fmt.Errorf("Not in a channel, use /part <channel>")
+			}
+			if !chat.PartChannel(name) {
+				return fmt.Errorf("Not in channel %s", name)
+			}
+			return nil
+		},
+	})
+	registry.Register(&ChatCommand{
+		Name:    "help",
+		Usage:   "/help [command]",
+		MinArgs: 0,
+		MaxArgs: 1,
+		Local:   true,
+		Run: func(chat *TwitchChat, channel *IrcChannel, args []string) error {
+			if len(args) > 0 {
+				cmd, ok := registry.commands[strings.TrimPrefix(args[0], "/")]
+				if !ok {
+					return fmt.Errorf("Unknown command %s", args[0])
+				}
+				chat.reply(channel, EventCommandReply, "Usage: "+cmd.Usage)
+				return nil
+			}
+			chat.reply(channel, EventCommandReply, "Commands: "+strings.Join(registry.Names(), ", "))
+			return nil
+		},
+	})
+
+	return registry
+}
+
+// Add a command to the registry, replacing any command with the same name
+func (registry *ChatCommands) Register(cmd *ChatCommand) {
+	registry.commands[cmd.Name] = cmd
+}
+
+// Sorted list of the registered commands
+func (registry *ChatCommands) Names() []string {
+	names := make([]string, 0, len(registry.commands))
+	for name := range registry.commands {
+		names = append(names, "/"+name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse a line starting with a slash into a command and its arguments
+func (registry *ChatCommands) Parse(line string) (*ChatCommand, []string, error) {
+	words := splitArgs(strings.TrimPrefix(line, "/"), 2)
+	if len(words) == 0 {
+		return nil, nil, fmt.Errorf("Empty command")
+	}
+	cmd, ok := registry.commands[strings.ToLower(words[0])]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unknown command /%s, try /help", words[0])
+	}
+
+	var args []string
+	if len(words) > 1 {
+		if cmd.Rest {
+			args = splitArgs(words[1], cmd.MaxArgs)
+		} else {
+			args = strings.Fields(words[1])
+		}
+	}
+	if len(args) < cmd.MinArgs || len(args) > cmd.MaxArgs {
+		return nil, nil, fmt.Errorf("Usage: %s", cmd.Usage)
+	}
+	return cmd, args, nil
+}
+
+// Split text on whitespace into at most n arguments, the last one keeping the rest of the text
+func splitArgs(text string, n int) []string {
+	var args []string
+	text = strings.TrimSpace(text)
+	for text != "" && n > 0 {
+		end := strings.IndexAny(text, " \t")
+		if len(args) == n-1 || end < 0 {
+			args = append(args, text)
+			break
+		}
+		args = append(args, text[:end])
+		text = strings.TrimSpace(text[end:])
+	}
+	return args
+}
+
+// Build a command which twitch handles when it is sent as a chat message
+func twitchCommand(name string, usage string, minArgs int, maxArgs int, rest bool, validate func(args []string) error) *ChatCommand {
+	return &ChatCommand{
+		Name:    name,
+		Usage:   usage,
+		MinArgs: minArgs,
+		MaxArgs: maxArgs,
+		Rest:    rest,
+		Run: func(chat *TwitchChat, channel *IrcChannel, args []string) error {
+			if validate != nil {
+				if err := validate(args); err != nil {
+					return fmt.Errorf("%s. Usage: %s", err, usage)
+				}
+			}
+			out := newOutgoingText(strings.TrimSpace("/" + name + " " + strings.Join(args, " ")))
+			out.Command = true
+			channel.SendChatMsg(out)
+			return nil
+		},
+	}
+}
+
+// Seconds in each unit a timeout duration may end in, as twitch accepts them
+var timeoutUnits = map[byte]int{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+
+// Timeouts take an optional duration of at most two weeks, in seconds or with
+// a unit such as 10m or 1h. Twitch is sent the duration as it was typed.
+func validateTimeout(args []string) error {
+	if len(args) < 2 {
+		return nil
+	}
+	number, unit := args[1], 1
+	if last := len(number) - 1; last > 0 && timeoutUnits[number[last]] > 0 {
+		number, unit = number[:last], timeoutUnits[number[last]]
+	}
+	seconds, err := strconv.Atoi(number)
+	if err != nil || seconds < 1 || seconds > 1209600/unit {
+		return fmt.Errorf("Invalid duration: %s", args[1])
+	}
+	return nil
+}
+
+// Check that the first argument, if any, is a number of seconds of at least min
+func validateSeconds(min int) func(args []string) error {
+	return func(args []string) error {
+		if len(args) == 0 {
+			return nil
+		}
+		seconds, err := strconv.Atoi(args[0])
+		if err != nil || seconds < min {
+			return fmt.Errorf("Invalid number of seconds: %s", args[0])
+		}
+		return nil
+	}
+}
+
+// Normalize a channel name typed by the user into an irc channel
+func channelName(name string) string {
+	return "#" + strings.ToLower(strings.TrimPrefix(name, "#"))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChatCommands(t *testing.T) {
+	Convey("Test parsing of slash commands", t, func() {
+		registry := NewChatCommands()
+
+		Convey("The reason of a timeout keeps its spacing", func() {
+			cmd, args, err := registry.Parse("/timeout someone 600 stop  spamming")
+			So(err, ShouldBeNil)
+			So(cmd.Name, ShouldEqual, "timeout")
+			So(args, ShouldResemble, []string{"someone", "600", "stop  spamming"})
+		})
+		Convey("A whisper needs a user and a message", func() {
+			_, _, err := registry.Parse("/w someone")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "/w <user> <message>")
+		})
+		Convey("Commands without arguments reject extra ones", func() {
+			_, _, err := registry.Parse("/clear everything")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Unknown commands are reported", func() {
+			_, _, err := registry.Parse("/frobnicate")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Invalid timeout durations are refused", func() {
+			So(validateTimeout([]string{"someone", "soon"}), ShouldNotBeNil)
+			So(validateTimeout([]string{"someone", "600"}), ShouldBeNil)
+			So(validateTimeout([]string{"someone", "3w"}), ShouldNotBeNil)
+			So(validateTimeout([]string{"someone", "m"}), ShouldNotBeNil)
+		})
+		Convey("Timeouts take durations with a unit", func() {
+			for _, duration := range []string{"10m", "1h", "1d", "2w", "30s"} {
+				So(validateTimeout([]string{"someone", duration}), ShouldBeNil)
+			}
+		})
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// Types of events delivered to chat clients
+const (
+	EventPrivMsg         = "privmsg"
+	EventUserNotice      = "usernotice"
+	EventClearChat       = "clearchat"
+	EventClearMsg        = "clearmsg"
+	EventRoomState       = "roomstate"
+	EventUserState       = "userstate"
+	EventGlobalUserState = "globaluserstate"
+	EventNotice          = "notice"
+	EventHostTarget      = "hosttarget"
+	EventReconnect       = "reconnect"
+	EventSendAck         = "send_ack"
+	EventSendFailed      = "send_failed"
+	EventQueue           = "queue"
+	EventCommandReply    = "command_reply"
+	EventCommandError    = "command_error"
+	EventLagged          = "lagged"
+	EventHighlight       = "highlight"
+	EventWhisper         = "whisper"
+)
+
+// A structured chat event, built from a single irc message
+type ChatEvent struct {
+	Type      string            `json:"type"`
+	Channel   string            `json:"channel,omitempty"`
+	Thread    string            `json:"thread,omitempty"` // login of the other side of a whisper conversation
+	Time      time.Time         `json:"time"`
+	User      string            `json:"user,omitempty"`      // login the event is about
+	Text      string            `json:"text,omitempty"`      // message body or notice text
+	Kind      string            `json:"kind,omitempty"`      // msg-id of notices, or timeout/ban/clear
+	Target    string            `json:"target,omitempty"`    // host target, gift recipient or deleted message id
+	Duration  int               `json:"duration,omitempty"`  // timeout length in seconds
+	Viewers   int               `json:"viewers,omitempty"`   // viewers brought by a host or raid
+	Queued    int               `json:"queued,omitempty"`    // messages waiting behind the rate limit
+	Dropped   int               `json:"dropped,omitempty"`   // events a lagging client missed
+	Highlight string            `json:"highlight,omitempty"` // type of the highlight rule the message matched
+	CanSend   *bool             `json:"canSend,omitempty"`   // whether messages can be sent, on session events
+	State     *RoomState        `json:"state,omitempty"`
+	Status    *ChannelStatus    `json:"status,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Html      string            `json:"html,omitempty"`
+}
+
+// Chat settings of a channel, as reported by ROOMSTATE
+type RoomState struct {
+	EmoteOnly     bool `json:"emote_only"`
+	FollowersOnly int  `json:"followers_only"` // minutes, -1 when disabled
+	R9K           bool `json:"r9k"`
+	Slow          int  `json:"slow"` // seconds between messages
+	SubsOnly      bool `json:"subs_only"`
+}
+
+// Encode an event for the websocket as json. Chat messages carry the html the
+// frontend renders in their html field.
+func (ev *ChatEvent) Bytes() []byte {
+	buf, _ := json.Marshal(ev)
+	return buf
+}
+
+// Create an event of the given type carrying the message's channel and tags
+func (channel *IrcChannel) newEvent(eventType string, msg *irc.Message) *ChatEvent {
+	ev := new(ChatEvent)
+	ev.Type = eventType
+	ev.Channel = channel.Name
+	ev.Time = time.Now()
+	if msg != nil {
+		if len(msg.Params) > 0 && strings.HasPrefix(msg.Params[0], "#") {
+			ev.Channel = msg.Params[0]
+		}
+		ev.Tags = parseTags(msg)
+	}
+	return ev
+}
+
+// Record an event and deliver it to whoever is reading this channel
+func (channel *IrcChannel) emit(ev *ChatEvent) {
+	channel.emitLock.Lock()
+	defer channel.emitLock.Unlock()
+	if channel.isClosed() || channel.readClosed {
+		return
+	}
+	// Connections sending as another account only tell whether twitch accepted the message
+	if channel.Config != nil && channel.Config.SendOnly && ev.Type != EventSendAck && ev.Type != EventSendFailed {
+		return
+	}
+	if channel.History != nil {
+		channel.History.Add(ev)
+	}
+	select {
+	case channel.ReadFromChannel <- ev:
+	default:
+		// Nobody is reading, the next client gets the event from the history instead
+	}
+}
+
+// Parse the IRCv3 tags sent in front of a message
+func parseTags(msg *irc.Message) map[string]string {
+	raw := msg.String()
+	if !strings.HasPrefix(raw, "@") {
+		return nil
+	}
+	if end := strings.Index(raw, " "); end > 0 {
+		raw = raw[1:end]
+	} else {
+		raw = raw[1:]
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		pair := strings.SplitN(tag, "=", 2)
+		if len(pair) == 2 {
+			tags[pair[0]] = unescapeTag(pair[1])
+		} else {
+			tags[pair[0]] = ""
+		}
+	}
+	return tags
+}
+
+var tagUnescaper = strings.NewReplacer(`\s`, " ", `\:`, ";", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+func unescapeTag(value string) string {
+	return tagUnescaper.Replace(value)
+}
+
+// Subscriptions, resubscriptions, gifted subscriptions and raids
+func (channel *IrcChannel) handleUserNotice(msg *irc.Message) {
+	ev := channel.newEvent(EventUserNotice, msg)
+	ev.Kind = ev.Tags["msg-id"]
+	ev.User = ev.Tags["login"]
+	ev.Text = msg.Trailing
+	ev.Target = ev.Tags["msg-param-recipient-user-name"]
+	ev.Viewers, _ = strconv.Atoi(ev.Tags["msg-param-viewerCount"])
+	channel.emit(ev)
+}
+
+// Timeouts, bans, and clearing the whole chat
+func (channel *IrcChannel) handleClearChat(msg *irc.Message) {
+	ev := channel.newEvent(EventClearChat, msg)
+	ev.User = msg.Trailing
+	if ev.User == "" {
+		ev.Kind = "clear"
+	} else if duration, ok := ev.Tags["ban-duration"]; ok {
+		ev.Kind = "timeout"
+		ev.Duration, _ = strconv.Atoi(duration)
+	} else {
+		ev.Kind = "ban"
+	}
+	channel.emit(ev)
+}
+
+// A single message was deleted
+func (channel *IrcChannel) handleClearMsg(msg *irc.Message) {
+	ev := channel.newEvent(EventClearMsg, msg)
+	ev.User = ev.Tags["login"]
+	ev.Target = ev.Tags["target-msg-id"]
+	ev.Text = msg.Trailing
+	channel.emit(ev)
+}
+
+// Chat settings changed, twitch only sends the tags that changed after the join
+func (channel *IrcChannel) handleRoomState(msg *irc.Message) {
+	ev := channel.newEvent(EventRoomState, msg)
+
+	channel.stateLock.Lock()
+	for key, value := range ev.Tags {
+		num, _ := strconv.Atoi(value)
+		switch key {
+		case "emote-only":
+			channel.RoomState.EmoteOnly = num != 0
+		case "followers-only":
+			channel.RoomState.FollowersOnly = num
+		case "r9k":
+			channel.RoomState.R9K = num != 0
+		case "slow":
+			channel.RoomState.Slow = num
+		case "subs-only":
+			channel.RoomState.SubsOnly = num != 0
+		}
+	}
+	state := channel.RoomState
+	channel.stateLock.Unlock()
+
+	ev.State = &state
+	channel.emit(ev)
+}
+
+// Our own badges and color, sent on join, after /color and after each message we send
+func (channel *IrcChannel) handleUserState(msg *irc.Message) {
+	ev := channel.newEvent(EventUserState, msg)
+	ev.User = channel.username()
+
+	channel.stateLock.Lock()
+	channel.UserState = ev.Tags
+	channel.stateLock.Unlock()
+
+	channel.emit(ev)
+
+	// Twitch answers every accepted message with a USERSTATE carrying the
+	// message's id. Those sent on join and after /color have none.
+	if ev.Tags["id"] == "" {
+		return
+	}
+	if out := channel.popPending(); out != nil {
+		channel.emitSendAck(out)
+	}
+}
+
+// Our global badges and color, sent once after logging in
+func (channel *IrcChannel) handleGlobalUserState(msg *irc.Message) {
+	ev := channel.newEvent(EventGlobalUserState, msg)
+	ev.User = channel.username()
+
+	channel.stateLock.Lock()
+	channel.GlobalUserState = ev.Tags
+	channel.stateLock.Unlock()
+
+	channel.emit(ev)
+}
+
+// Server notices, such as slow mode being enabled or a message being rejected
+func (channel *IrcChannel) handleNotice(msg *irc.Message) {
+	ev := channel.newEvent(EventNotice, msg)
+	ev.Kind = ev.Tags["msg-id"]
+	ev.Text = msg.Trailing
+	channel.emit(ev)
+
+	if isRejectionNotice(ev.Kind) {
+		if out := channel.popPending(); out != nil {
+			channel.emitSendFailed(out, ev.Kind, ev.Text)
+		}
+	}
+}
+
+// The channel started or stopped hosting another channel
+func (channel *IrcChannel) handleHostTarget(msg *irc.Message) {
+	ev := channel.newEvent(EventHostTarget, msg)
+
+	// The trailing part is "<target> [viewers]", where target is "-" when hosting stops
+	fields := strings.Fields(msg.Trailing)
+	if len(fields) > 0 && fields[0] != "-" {
+		ev.Kind = "host"
+		ev.Target = fields[0]
+	} else {
+		ev.Kind = "unhost"
+	}
+	if len(fields) > 1 {
+		ev.Viewers, _ = strconv.Atoi(fields[1])
+	}
+	channel.emit(ev)
+}
+
+// Twitch is about to restart the server we are connected to
+func (channel *IrcChannel) handleReconnect(msg *irc.Message) {
+	channel.emit(channel.newEvent(EventReconnect, msg))
+	// Dropping the connection makes RecvLoop reconnect
+	channel.closeConn()
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/sorcix/irc"
+)
+
+// Create a channel which is not connected anywhere, for feeding it messages
+func newTestChannel() *IrcChannel {
+	channel := new(IrcChannel)
+	channel.Name = "#test_channel"
+	channel.Config = &IrcConfig{Username: "test_user"}
+	channel.Colors = NewColorCache(16)
+	channel.ReadFromChannel = make(chan *ChatEvent, 16)
+	channel.RoomState.FollowersOnly = -1
+	return channel
+}
+
+func TestChatEvents(t *testing.T) {
+	Convey("Test parsing of IRCv3 tags", t, func() {
+		msg := irc.ParseMessage(`@msg-id=resub;system-msg=5\smonths\:\sthanks :tmi.twitch.tv USERNOTICE #test_channel :hi`)
+		tags := parseTags(msg)
+		So(tags["msg-id"], ShouldEqual, "resub")
+		So(tags["system-msg"], ShouldEqual, "5 months; thanks")
+	})
+
+	Convey("Test handling of twitch's irc commands", t, func() {
+		channel := newTestChannel()
+
+		Convey("A timeout is reported with its duration", func() {
+			channel.handleClearChat(irc.ParseMessage(`@ban-duration=600 :tmi.twitch.tv CLEARCHAT #test_channel :someone`))
+			ev := <-channel.ReadFromChannel
+			So(ev.Type, ShouldEqual, EventClearChat)
+			So(ev.Kind, ShouldEqual, "timeout")
+			So(ev.User, ShouldEqual, "someone")
+			So(ev.Duration, ShouldEqual, 600)
+		})
+		Convey("A raid carries the viewer count", func() {
+			channel.handleUserNotice(irc.ParseMessage(`@login=raider;msg-id=raid;msg-param-viewerCount=42 :tmi.twitch.tv USERNOTICE #test_channel`))
+			ev := <-channel.ReadFromChannel
+			So(ev.Kind, ShouldEqual, "raid")
+			So(ev.User, ShouldEqual, "raider")
+			So(ev.Viewers, ShouldEqual, 42)
+		})
+		Convey("Room state accumulates partial updates", func() {
+			channel.handleRoomState(irc.ParseMessage(`@slow=10;subs-only=0 :tmi.twitch.tv ROOMSTATE #test_channel`))
+			<-channel.ReadFromChannel
+			channel.handleRoomState(irc.ParseMessage(`@subs-only=1 :tmi.twitch.tv ROOMSTATE #test_channel`))
+			ev := <-channel.ReadFromChannel
+			So(ev.State.Slow, ShouldEqual, 10)
+			So(ev.State.SubsOnly, ShouldBeTrue)
+			So(ev.State.FollowersOnly, ShouldEqual, -1)
+		})
+		Convey("Ending a host has no target", func() {
+			channel.handleHostTarget(irc.ParseMessage(`:tmi.twitch.tv HOSTTARGET #test_channel :- 0`))
+			ev := <-channel.ReadFromChannel
+			So(ev.Kind, ShouldEqual, "unhost")
+			So(ev.Target, ShouldEqual, "")
+		})
+	})
+}
+
+func TestChatSendAck(t *testing.T) {
+	Convey("Test matching twitch's answers to the messages we sent", t, func() {
+		channel := newTestChannel()
+		channel.addPending(NewOutgoingMsg([]byte(`{"id":"first","text":"hello"}`)))
+		channel.addPending(NewOutgoingMsg([]byte("second")))
+
+		Convey("A USERSTATE acknowledges the oldest message and echoes it", func() {
+			channel.handleUserState(irc.ParseMessage(`@color=#123456;display-name=Test_User;id=abc-123;subscriber=1 :tmi.twitch.tv USERSTATE #test_channel`))
+			So((<-channel.ReadFromChannel).Type, ShouldEqual, EventUserState)
+			echo := <-channel.ReadFromChannel
+			So(echo.Type, ShouldEqual, EventPrivMsg)
+			So(echo.Html, ShouldContainSubstring, "color:#123456")
+			So(echo.Html, ShouldContainSubstring, "Test_User")
+			sent := new(ChatEvent)
+			So(json.Unmarshal(echo.Bytes(), sent), ShouldBeNil)
+			So(sent.Html, ShouldEqual, echo.Html)
+			ack := <-channel.ReadFromChannel
+			So(ack.Type, ShouldEqual, EventSendAck)
+			So(ack.Target, ShouldEqual, "first")
+		})
+		Convey("The USERSTATE sent on join acknowledges nothing", func() {
+			channel.handleUserState(irc.ParseMessage(`@color=#123456;display-name=Test_User;subscriber=1 :tmi.twitch.tv USERSTATE #test_channel`))
+			So((<-channel.ReadFromChannel).Type, ShouldEqual, EventUserState)
+			So(channel.ReadFromChannel, ShouldBeEmpty)
+			So(channel.popPending().Id, ShouldEqual, "first")
+		})
+		Convey("The echo of a /me message stays an action", func() {
+			channel.popPending()
+			channel.popPending()
+			out := newOutgoingText("waves")
+			out.Action = true
+			channel.addPending(out)
+			channel.handleUserState(irc.ParseMessage(`@display-name=Test_User;id=abc-123 :tmi.twitch.tv USERSTATE #test_channel`))
+			<-channel.ReadFromChannel
+			echo := <-channel.ReadFromChannel
+			So(echo.Text, ShouldEqual, "\x01ACTION waves\x01")
+			So(ircLogLine(echo), ShouldStartWith, " * ")
+			So(ircLogLine(echo), ShouldEndWith, " waves")
+		})
+		Convey("Messages left unanswered fail without waiting for the next one", func() {
+			channel.expirePending(time.Now())
+			So(channel.ReadFromChannel, ShouldBeEmpty)
+
+			channel.expirePending(time.Now().Add(sendAckTimeout + time.Second))
+			So((<-channel.ReadFromChannel).Target, ShouldEqual, "first")
+			failed := <-channel.ReadFromChannel
+			So(failed.Type, ShouldEqual, EventSendFailed)
+			So(failed.Kind, ShouldEqual, "timeout")
+			So(channel.popPending(), ShouldBeNil)
+		})
+		Convey("A msg_ NOTICE rejects the oldest message", func() {
+			channel.handleNotice(irc.ParseMessage(`@msg-id=msg_duplicate :tmi.twitch.tv NOTICE #test_channel :Your message was not sent`))
+			So((<-channel.ReadFromChannel).Type, ShouldEqual, EventNotice)
+			failed := <-channel.ReadFromChannel
+			So(failed.Type, ShouldEqual, EventSendFailed)
+			So(failed.Target, ShouldEqual, "first")
+			So(failed.Kind, ShouldEqual, "msg_duplicate")
+		})
+	})
+}
+
+func TestChatHighlights(t *testing.T) {
+	Convey("Test highlighting of chat messages", t, func() {
+		highlighter := NewHighlighter()
+
+		Convey("Mentions of our own username are highlighted by default", func() {
+			kind, ok := highlighter.Match(&ChatEvent{User: "someone", Text: "hi @Me!"}, "me")
+			So(ok, ShouldBeTrue)
+			So(kind, ShouldEqual, HighlightUsername)
+		})
+		Convey("Our own messages are never highlighted", func() {
+			_, ok := highlighter.Match(&ChatEvent{User: "me", Text: "me"}, "me")
+			So(ok, ShouldBeFalse)
+		})
+		Convey("Regex and user rules match", func() {
+			So(highlighter.SetRules([]HighlightRule{{Type: HighlightRegex, Pattern: `\bgiveaway\b`}, {Type: HighlightUser, Pattern: "@Friend"}}), ShouldBeNil)
+			_, ok := highlighter.Match(&ChatEvent{User: "someone", Text: "GIVEAWAY now"}, "me")
+			So(ok, ShouldBeTrue)
+			kind, ok := highlighter.Match(&ChatEvent{User: "friend", Text: "hello"}, "me")
+			So(ok, ShouldBeTrue)
+			So(kind, ShouldEqual, HighlightUser)
+		})
+		Convey("Invalid rules leave the old ones in place", func() {
+			So(highlighter.SetRules([]HighlightRule{{Type: HighlightRegex, Pattern: "("}}), ShouldNotBeNil)
+			So(highlighter.Rules(), ShouldResemble, []HighlightRule{{Type: HighlightUsername}})
+		})
+	})
+}
+
+func TestChatFilters(t *testing.T) {
+	Convey("Test filtering of chat messages", t, func() {
+		filters := NewChatFilters()
+
+		Convey("Ignored users are hidden by login or user id", func() {
+			So(filters.Ignore("@Spammer"), ShouldBeNil)
+			So(filters.Ignore("1234"), ShouldBeNil)
+			_, show := filters.Apply("spammer", "1", "hi")
+			So(show, ShouldBeFalse)
+			_, show = filters.Apply("renamed", "1234", "hi")
+			So(show, ShouldBeFalse)
+		})
+		Convey("Filters replace or hide matching messages", func() {
+			So(filters.SetFilters([]ChatFilter{
+				{Pattern: "darn", Word: true, Action: FilterReplace, Replacement: "****"},
+				{Pattern: `buy (cheap )?followers`, Action: FilterHide},
+			}, true), ShouldBeNil)
+			text, show := filters.Apply("someone", "", "Darn it, darnation")
+			So(show, ShouldBeTrue)
+			So(text, ShouldEqual, "**** it, darnation")
+			_, show = filters.Apply("someone", "", "BUY FOLLOWERS at example.com")
+			So(show, ShouldBeFalse)
+			_, show = filters.Apply("someone", "", "!uptime")
+			So(show, ShouldBeFalse)
+		})
+		Convey("Unknown actions are refused", func() {
+			So(filters.SetFilters([]ChatFilter{{Pattern: "x", Action: "explode"}}, false), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestChatWhispers(t *testing.T) {
+	Convey("Test receiving whispers", t, func() {
+		channel := newTestChannel()
+		channel.Whispers = NewWhispers()
+		channel.History = NewChatHistory(16, "")
+		whisper := `@message-id=7;thread-id=1_2;user-id=2 :Friend!friend@friend.tmi.twitch.tv WHISPER test_user :psst`
+
+		Convey("A whisper is an event of its own thread, outside of any channel", func() {
+			channel.handleWhisper(irc.ParseMessage(whisper))
+			ev := <-channel.ReadFromChannel
+			So(ev.Type, ShouldEqual, EventWhisper)
+			So(ev.Channel, ShouldEqual, "")
+			So(ev.Thread, ShouldEqual, "Friend")
+			So(ev.Text, ShouldEqual, "psst")
+			So(channel.History.Recent("@friend", 0), ShouldHaveLength, 1)
+		})
+		Convey("The copy received by another connection is dropped", func() {
+			channel.handleWhisper(irc.ParseMessage(whisper))
+			channel.handleWhisper(irc.ParseMessage(whisper))
+			So(channel.ReadFromChannel, ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestChatAnonymous(t *testing.T) {
+	Convey("Test anonymous chat", t, func() {
+		channel := newTestChannel()
+		channel.Anonymous = true
+		chat := &TwitchChat{auth: new(TwitchAuth), current: channel, hub: NewChatHub()}
+
+		Convey("Anonymous logins use a justinfan nick", func() {
+			So(anonymousNick(), ShouldStartWith, "justinfan")
+		})
+		Convey("Messages are refused while reading anonymously", func() {
+			chat.Submit(newOutgoingText("hello"))
+			ev := <-channel.ReadFromChannel
+			So(ev.Type, ShouldEqual, EventCommandError)
+			So(ev.Text, ShouldEqual, errReadOnly.Error())
+			So(*chat.sessionEvent().CanSend, ShouldBeFalse)
+		})
+		Convey("Channels can still be left while reading anonymously", func() {
+			channel.Conn, _ = net.Pipe()
+			channel.done = make(chan struct{})
+			chat.channels = []*IrcChannel{channel}
+			chat.commands = NewChatCommands()
+			chat.Submit(newOutgoingText("/part"))
+			So(chat.Channels(), ShouldBeEmpty)
+			So(channel.ReadFromChannel, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestChatHealth(t *testing.T) {
+	Convey("Test monitoring of the chat connection", t, func() {
+		channel := newTestChannel()
+		conn, server := net.Pipe()
+		channel.Conn = conn
+		channel.Writer = irc.NewEncoder(conn)
+		lines := irc.NewDecoder(server)
+		start := time.Now()
+
+		channel.touch()
+		ev := <-channel.ReadFromChannel
+		So(ev.Type, ShouldEqual, EventStatus)
+		So(ev.Status.Connected, ShouldBeTrue)
+
+		Convey("Pings measure the latency", func() {
+			go channel.checkHealth(start)
+			ping, err := lines.Decode()
+			So(err, ShouldBeNil)
+			So(ping.Command, ShouldEqual, irc.PING)
+
+			channel.handlePong(&irc.Message{Command: irc.PONG, Trailing: ping.Trailing})
+			ev := <-channel.ReadFromChannel
+			So(ev.Status.Latency, ShouldBeGreaterThanOrEqualTo, 0)
+			So(channel.health.pingSent.IsZero(), ShouldBeTrue)
+		})
+		Convey("A ping without an answer closes the connection", func() {
+			go channel.checkHealth(start)
+			_, err := lines.Decode()
+			So(err, ShouldBeNil)
+
+			channel.checkHealth(start.Add(pongTimeout + time.Second))
+			_, err = lines.Decode()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDisconnect(t *testing.T) {
+	Convey("Test disconnecting a channel messages are still sent to", t, func() {
+		channel := newTestChannel()
+		channel.Conn, _ = net.Pipe()
+		channel.PostToChannel = make(chan *OutgoingMsg)
+		channel.done = make(chan struct{})
+		stopped := make(chan bool)
+		go func() {
+			channel.SendLoop()
+			stopped <- true
+		}()
+
+		channel.Disconnect()
+		So(func() { channel.Disconnect() }, ShouldNotPanic)
+		So(func() { channel.SendChatMsg(newOutgoingText("hello")) }, ShouldNotPanic)
+		So(<-stopped, ShouldBeTrue)
+	})
+}
+
+func TestChatSendLoop(t *testing.T) {
+	Convey("Test sending the queued messages", t, func() {
+		channel := newTestChannel()
+		channel.Config.Limits = NewChatLimits()
+		conn, server := net.Pipe()
+		channel.Conn = conn
+		channel.Writer = irc.NewEncoder(conn)
+		channel.PostToChannel = make(chan *OutgoingMsg, 1)
+		channel.done = make(chan struct{})
+		go channel.SendLoop()
+		defer channel.Disconnect()
+
+		Convey("A message waits for its answer before twitch can send it", func() {
+			channel.SendChatMsg(newOutgoingText("hello"))
+			msg, err := irc.NewDecoder(server).Decode()
+			So(err, ShouldBeNil)
+			So(msg.Trailing, ShouldEqual, "hello")
+			So(channel.popPending().Text, ShouldEqual, "hello")
+		})
+		Convey("A message which could not be written waits for nothing", func() {
+			server.Close()
+			channel.SendChatMsg(newOutgoingText("hello"))
+			failed := <-channel.ReadFromChannel
+			So(failed.Type, ShouldEqual, EventSendFailed)
+			So(channel.popPending(), ShouldBeNil)
+		})
+	})
+}
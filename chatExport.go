@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// What to export from the stored chat
+type ChatExport struct {
+	Channel     string    `json:"channel"`
+	Since       time.Time `json:"since"`
+	Until       time.Time `json:"until"`
+	Format      string    `json:"format"`       // irc, jsonl or html
+	StreamStart time.Time `json:"stream_start"` // Timestamps are relative to it when set
+}
+
+// An exported event, with its time relative to the stream start when one was given
+type exportRecord struct {
+	*ChatEvent
+	Offset *float64 `json:"offset,omitempty"`
+}
+
+// Styling of exported html transcripts, matching the ids used by handlePrivMsg
+const exportHtmlHeader = `<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="utf-8">
+		<title>%s</title>
+		<style>
+			body { background: #18181B; color: #EFEFF1; font-family: sans-serif; font-size: 14px; }
+			.line { padding: 2px 0; }
+			.time { color: #ADADB8; font-size: 12px; margin-right: 4px; }
+			.event #text { color: #ADADB8; font-style: italic; }
+		</style>
+	</head>
+	<body>
+		<h1>%s</h1>
+`
+
+const exportHtmlFooter = `	</body>
+</html>
+`
+
+// Write a channel's stored events in the requested format
+func (history *ChatHistory) Export(export *ChatExport, out io.Writer) error {
+	if export.Channel == "" {
+		return fmt.Errorf("No channel to export")
+	}
+	if err := validHistoryKey(channelName(export.Channel)); err != nil {
+		return err
+	}
+	query := &ChatSearch{Since: export.Since, Until: export.Until}
+	events := history.Matching(channelName(export.Channel), func(ev *ChatEvent) bool {
+		return query.matches(ev, nil)
+	})
+
+	writer := bufio.NewWriter(out)
+	switch export.Format {
+	case "", "irc":
+		for _, ev := range events {
+			fmt.Fprintf(writer, "%s %s\n", export.timestamp(ev), ircLogLine(ev))
+		}
+	case "jsonl":
+		encoder := json.NewEncoder(writer)
+		for _, ev := range events {
+			record := &exportRecord{ChatEvent: ev}
+			if !export.StreamStart.IsZero() {
+				offset := ev.Time.Sub(export.StreamStart).Seconds()
+				record.Offset = &offset
+			}
+			encoder.Encode(record)
+		}
+	case "html":
+		title := html.EscapeString("Chat of " + channelName(export.Channel))
+		fmt.Fprintf(writer, exportHtmlHeader, title, title)
+		for _, ev := range events {
+			fmt.Fprintf(writer, "\t\t<div class='line'><span class='time'>%s</span>%s</div>\n", export.timestamp(ev), htmlLogLine(ev))
+		}
+		writer.WriteString(exportHtmlFooter)
+	default:
+		return fmt.Errorf("Unknown export format: %s", export.Format)
+	}
+	return writer.Flush()
+}
+
+// Format an event's time, as an offset into the stream when its start is known
+func (export *ChatExport) timestamp(ev *ChatEvent) string {
+	if export.StreamStart.IsZero() {
+		return ev.Time.Local().Format("15:04:05")
+	}
+
+	offset := ev.Time.Sub(export.StreamStart)
+	sign := ""
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	seconds := int(offset / time.Second)
+	return fmt.Sprintf("%s%d:%02d:%02d", sign, seconds/3600, seconds/60%60, seconds%60)
+}
+
+// Name to show for the user of an event
+func exportNick(ev *ChatEvent) string {
+	if name := ev.Tags["display-name"]; name != "" {
+		return name
+	}
+	return ev.User
+}
+
+// Describe an event which is not a chat message
+func eventDescription(ev *ChatEvent) string {
+	switch ev.Type {
+	case EventUserNotice:
+		if ev.Text != "" {
+			return strings.TrimSpace(ev.Tags["system-msg"] + " " + exportNick(ev) + ": " + ev.Text)
+		}
+		return ev.Tags["system-msg"]
+	case EventClearChat:
+		switch ev.Kind {
+		case "timeout":
+			return fmt.Sprintf("%s was timed out for %d seconds", ev.User, ev.Duration)
+		case "ban":
+			return ev.User + " was banned"
+		}
+		return "Chat was cleared"
+	case EventClearMsg:
+		return "A message from " + ev.User + " was deleted: " + ev.Text
+	}
+	return ev.Text
+}
+
+// Format an event the way irssi logs it
+func ircLogLine(ev *ChatEvent) string {
+	if ev.Type != EventPrivMsg {
+		return "-!- " + eventDescription(ev)
+	}
+	if strings.HasPrefix(ev.Text, "\x01ACTION ") {
+		return " * " + exportNick(ev) + " " + strings.TrimSuffix(strings.TrimPrefix(ev.Text, "\x01ACTION "), "\x01")
+	}
+	return "< " + exportNick(ev) + "> " + ev.Text
+}
+
+// Format an event for an html transcript, reusing the html the frontend gets
+func htmlLogLine(ev *ChatEvent) string {
+	if ev.Type == EventPrivMsg && ev.Html != "" {
+		return ev.Html
+	}
+	if ev.Type == EventPrivMsg {
+		return "<span id='username'><strong>" + html.EscapeString(exportNick(ev)) + "</strong></span><span id='text'>: " + html.EscapeString(ev.Text) + " </span>"
+	}
+	return "<span class='event'><span id='text'>" + html.EscapeString(eventDescription(ev)) + "</span></span>"
+}
+
+// Parse a time given on the command line, empty means no time
+func parseExportTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// The export-chat subcommand, which reads the chat logs without needing the daemon
+func runExportChat(args []string) int {
+	flags := flag.NewFlagSet("export-chat", flag.ContinueOnError)
+	channel := flags.String("channel", "", "channel to export")
+	format := flags.String("format", "irc", "output format: irc, jsonl or html")
+	since := flags.String("since", "", "only export messages sent after this time (RFC 3339)")
+	until := flags.String("until", "", "only export messages sent before this time (RFC 3339)")
+	streamStart := flags.String("stream-start", "", "print timestamps relative to this time (RFC 3339)")
+	output := flags.String("o", "", "file to write to, defaults to stdout")
+	logDir := flags.String("log-dir", path.Join(dataDir(), "logs"), "directory holding the chat logs")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	export := &ChatExport{Channel: *channel, Format: *format}
+	var err error
+	if export.Since, err = parseExportTime(*since); err != nil {
+		log.Print("Invalid -since: ", err)
+		return 2
+	}
+	if export.Until, err = parseExportTime(*until); err != nil {
+		log.Print("Invalid -until: ", err)
+		return 2
+	}
+	if export.StreamStart, err = parseExportTime(*streamStart); err != nil {
+		log.Print("Invalid -stream-start: ", err)
+		return 2
+	}
+
+	history := NewChatHistory(0, *logDir)
+	if file, err := history.logPath(channelName(*channel)); err != nil {
+		log.Print(err)
+		return 2
+	} else if _, err := os.Stat(file); err != nil {
+		log.Print("No chat log for ", channelName(*channel), ", set log = true under [chat] in twicciand.toml to keep one")
+		return 1
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Print("Could not create output file: ", err)
+			return 1
+		}
+		defer out.Close()
+	}
+
+	if err := history.Export(export, out); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
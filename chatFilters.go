@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// What a filter does with a matching message
+const (
+	FilterHide    = "hide"    // Drop the message
+	FilterReplace = "replace" // Replace the matching text with Replacement
+)
+
+// A rule hiding or rewriting chat messages
+type ChatFilter struct {
+	Pattern     string `json:"pattern"`
+	Word        bool   `json:"word,omitempty"` // Pattern is a plain word rather than a regex
+	Action      string `json:"action"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// Saved form of the filters
+type chatFiltersFile struct {
+	Ignored         []string     `json:"ignored"`
+	Filters         []ChatFilter `json:"filters"`
+	HideBotCommands bool         `json:"hide_bot_commands"`
+}
+
+// Local moderation of what we see in chat: ignored users and message filters
+type ChatFilters struct {
+	ignored         map[string]bool // Lowercase logins and user ids
+	filters         []ChatFilter
+	regex           []*regexp.Regexp
+	hideBotCommands bool
+	lock            sync.RWMutex
+}
+
+func NewChatFilters() *ChatFilters {
+	filters := new(ChatFilters)
+	filters.ignored = make(map[string]bool)
+	return filters
+}
+
+// Ignore a user, given by login or user id
+func (filters *ChatFilters) Ignore(user string) error {
+	user = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(user), "@"))
+	if user == "" {
+		return fmt.Errorf("No user to ignore")
+	}
+	filters.lock.Lock()
+	filters.ignored[user] = true
+	filters.lock.Unlock()
+	return nil
+}
+
+// Stop ignoring a user
+func (filters *ChatFilters) Unignore(user string) {
+	filters.lock.Lock()
+	delete(filters.ignored, strings.ToLower(strings.TrimPrefix(strings.TrimSpace(user), "@")))
+	filters.lock.Unlock()
+}
+
+// Replace the filters, leaving the old ones in place if any of the new ones is invalid
+func (filters *ChatFilters) SetFilters(rules []ChatFilter, hideBotCommands bool) error {
+	compiled := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		if rule.Action != FilterHide && rule.Action != FilterReplace {
+			return fmt.Errorf("Unknown filter action: %s", rule.Action)
+		}
+		pattern := rule.Pattern
+		if rule.Word {
+			pattern = `\b` + regexp.QuoteMeta(pattern) + `\b`
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid filter pattern %q: %s", rule.Pattern, err)
+		}
+		compiled[i] = re
+	}
+
+	filters.lock.Lock()
+	filters.filters = rules
+	filters.regex = compiled
+	filters.hideBotCommands = hideBotCommands
+	filters.lock.Unlock()
+	return nil
+}
+
+// Snapshot of the ignore list and filters, in the form they are saved in
+func (filters *ChatFilters) rules() *chatFiltersFile {
+	filters.lock.RLock()
+	defer filters.lock.RUnlock()
+	saved := &chatFiltersFile{
+		Ignored:         []string{},
+		Filters:         append([]ChatFilter{}, filters.filters...),
+		HideBotCommands: filters.hideBotCommands,
+	}
+	for user := range filters.ignored {
+		saved.Ignored = append(saved.Ignored, user)
+	}
+	return saved
+}
+
+// Check a message from a user, returning the text to show and whether it should be shown at all
+func (filters *ChatFilters) Apply(login string, userId string, text string) (string, bool) {
+	filters.lock.RLock()
+	defer filters.lock.RUnlock()
+
+	if filters.ignored[strings.ToLower(login)] || (userId != "" && filters.ignored[userId]) {
+		return text, false
+	}
+	if filters.hideBotCommands && strings.HasPrefix(text, "!") {
+		return text, false
+	}
+	for i, rule := range filters.filters {
+		if !filters.regex[i].MatchString(text) {
+			continue
+		}
+		if rule.Action == FilterHide {
+			return text, false
+		}
+		text = filters.regex[i].ReplaceAllLiteralString(text, rule.Replacement)
+	}
+	return text, true
+}
+
+// Load the ignore list and filters saved in a file, a missing file means no filtering
+func (filters *ChatFilters) Load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var saved chatFiltersFile
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("Could not parse %s: %s", file, err)
+	}
+	if err = filters.SetFilters(saved.Filters, saved.HideBotCommands); err != nil {
+		return err
+	}
+	// Loading again, such as when reloading the settings, forgets users no longer in the file
+	ignored := make(map[string]bool)
+	for _, user := range saved.Ignored {
+		if user = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(user), "@")); user != "" {
+			ignored[user] = true
+		}
+	}
+	filters.lock.Lock()
+	filters.ignored = ignored
+	filters.lock.Unlock()
+	return nil
+}
+
+// Save the ignore list and filters to a file
+func (filters *ChatFilters) Save(file string) error {
+	data, err := json.MarshalIndent(filters.rules(), "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0600)
+}
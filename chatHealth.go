@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// How often the connection is checked, and how long twitch may take to answer a ping
+const (
+	healthInterval = 10 * time.Second
+	pongTimeout    = 5 * time.Second
+)
+
+// Sent to websocket clients whenever a channel's connection changes or its latency is measured
+const EventStatus = "status"
+
+// Health of a channel's connection
+type ChannelStatus struct {
+	Channel     string    `json:"channel"`
+	Connected   bool      `json:"connected"`
+	Anonymous   bool      `json:"anonymous"`
+	Latency     int64     `json:"latency_ms"` // round trip of the last ping, 0 until measured
+	LastMessage time.Time `json:"last_message"`
+	Reconnects  int       `json:"reconnects"`
+}
+
+// Connection state tracked by the health monitor, guarded by the channel's stateLock
+type channelHealth struct {
+	connected   bool
+	latency     time.Duration
+	lastMessage time.Time
+	reconnects  int
+	pingToken   string    // Token of the ping waiting for its pong
+	pingSent    time.Time // When it was sent, zero when no ping is outstanding
+	lastPing    time.Time
+}
+
+// Snapshot of the channel's health
+func (channel *IrcChannel) Status() ChannelStatus {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
+	return ChannelStatus{
+		Channel:     channel.Name,
+		Connected:   channel.health.connected,
+		Anonymous:   channel.Anonymous,
+		Latency:     int64(channel.health.latency / time.Millisecond),
+		LastMessage: channel.health.lastMessage,
+		Reconnects:  channel.health.reconnects,
+	}
+}
+
+// Tell clients about the channel's health
+func (channel *IrcChannel) emitStatus() {
+	status := channel.Status()
+	ev := channel.newEvent(EventStatus, nil)
+	ev.Status = &status
+	channel.emit(ev)
+}
+
+// Note that something arrived from the server, which proves the connection alive
+func (channel *IrcChannel) touch() {
+	channel.stateLock.Lock()
+	changed := !channel.health.connected
+	channel.health.connected = true
+	channel.health.lastMessage = time.Now()
+	channel.stateLock.Unlock()
+	if changed {
+		channel.emitStatus()
+	}
+}
+
+// Mark the connection as lost, counting the reconnect about to happen
+func (channel *IrcChannel) lost() {
+	channel.stateLock.Lock()
+	channel.health.connected = false
+	channel.health.reconnects++
+	channel.health.pingSent = time.Time{}
+	channel.stateLock.Unlock()
+	channel.emitStatus()
+}
+
+// Measure the latency when twitch answers our ping
+func (channel *IrcChannel) handlePong(msg *irc.Message) {
+	channel.stateLock.Lock()
+	if channel.health.pingSent.IsZero() || msg.Trailing != channel.health.pingToken {
+		channel.stateLock.Unlock()
+		return
+	}
+	channel.health.latency = time.Since(channel.health.pingSent)
+	channel.health.pingSent = time.Time{}
+	channel.stateLock.Unlock()
+	channel.emitStatus()
+}
+
+// Ping the server regularly, closing the connection when it stops answering
+// so RecvLoop reconnects, and fail messages twitch never answered. Runs until
+// the channel is disconnected.
+func (channel *IrcChannel) Monitor() {
+	ticker := time.NewTicker(healthInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-channel.done:
+			return
+		case now := <-ticker.C:
+			channel.checkHealth(now)
+			channel.expirePending(now)
+		}
+	}
+}
+
+func (channel *IrcChannel) checkHealth(now time.Time) {
+	channel.stateLock.Lock()
+	health := channel.health
+	channel.stateLock.Unlock()
+
+	if !health.connected {
+		return
+	}
+	if !health.pingSent.IsZero() {
+		if now.Sub(health.pingSent) > pongTimeout {
+			log.Print("Chat channel ", channel.Name, " stopped answering, reconnecting")
+			channel.closeConn()
+		}
+		return
+	}
+	if now.Sub(health.lastPing) < healthInterval {
+		return
+	}
+
+	token := fmt.Sprintf("twicciand-%d", now.UnixNano())
+	channel.stateLock.Lock()
+	channel.health.pingToken = token
+	channel.health.pingSent = now
+	channel.health.lastPing = now
+	channel.stateLock.Unlock()
+	channel.Send(&irc.Message{Command: irc.PING, Trailing: token})
+}
+
+// Health of every channel we are in
+func (chat *TwitchChat) Status() []ChannelStatus {
+	statuses := []ChannelStatus{}
+	for _, channel := range chat.Channels() {
+		statuses = append(statuses, channel.Status())
+	}
+	return statuses
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Kinds of highlight rules
+const (
+	HighlightUsername     = "username"      // Someone mentions our own username
+	HighlightRegex        = "regex"         // The message matches Pattern
+	HighlightUser         = "user"          // The message was sent by the user named in Pattern
+	HighlightFirstMessage = "first_message" // The user never chatted in the channel before
+)
+
+// A rule deciding which chat messages should be highlighted
+type HighlightRule struct {
+	Type    string `json:"type"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Evaluates highlight rules against chat messages
+type Highlighter struct {
+	rules []HighlightRule
+	regex []*regexp.Regexp // Compiled patterns, nil for rules which are not regexes
+	lock  sync.RWMutex
+}
+
+func NewHighlighter() *Highlighter {
+	highlighter := new(Highlighter)
+	highlighter.rules = []HighlightRule{{Type: HighlightUsername}}
+	highlighter.regex = []*regexp.Regexp{nil}
+	return highlighter
+}
+
+// Replace the rules, leaving the old ones in place if any of the new ones is invalid
+func (highlighter *Highlighter) SetRules(rules []HighlightRule) error {
+	compiled := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		switch rule.Type {
+		case HighlightRegex:
+			re, err := regexp.Compile("(?i)" + rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("Invalid highlight pattern %q: %s", rule.Pattern, err)
+			}
+			compiled[i] = re
+		case HighlightUser:
+			if rule.Pattern == "" {
+				return fmt.Errorf("Highlight rule for a user is missing the user")
+			}
+		case HighlightUsername, HighlightFirstMessage:
+		default:
+			return fmt.Errorf("Unknown highlight rule: %s", rule.Type)
+		}
+	}
+
+	highlighter.lock.Lock()
+	highlighter.rules = rules
+	highlighter.regex = compiled
+	highlighter.lock.Unlock()
+	return nil
+}
+
+// The current rules
+func (highlighter *Highlighter) Rules() []HighlightRule {
+	highlighter.lock.RLock()
+	defer highlighter.lock.RUnlock()
+	return append([]HighlightRule(nil), highlighter.rules...)
+}
+
+// Check a chat message against the rules, returning the type of the first matching rule.
+// username is our own login, our own messages are never highlighted.
+func (highlighter *Highlighter) Match(ev *ChatEvent, username string) (string, bool) {
+	if strings.EqualFold(ev.User, username) {
+		return "", false
+	}
+
+	highlighter.lock.RLock()
+	defer highlighter.lock.RUnlock()
+	for i, rule := range highlighter.rules {
+		matched := false
+		switch rule.Type {
+		case HighlightUsername:
+			matched = username != "" && mentions(ev.Text, username)
+		case HighlightRegex:
+			matched = highlighter.regex[i].MatchString(ev.Text)
+		case HighlightUser:
+			matched = strings.EqualFold(strings.TrimPrefix(rule.Pattern, "@"), ev.User)
+		case HighlightFirstMessage:
+			matched = ev.Tags["first-msg"] == "1"
+		}
+		if matched {
+			return rule.Type, true
+		}
+	}
+	return "", false
+}
+
+// Check if text mentions a user as a whole word, with or without an @
+func mentions(text string, username string) bool {
+	for _, word := range tokenize(text) {
+		if strings.EqualFold(word, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load highlight rules saved in a file, a missing file keeps the default rules
+func (highlighter *Highlighter) Load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var rules []HighlightRule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("Could not parse %s: %s", file, err)
+	}
+	return highlighter.SetRules(rules)
+}
+
+// Save the current rules to a file
+func (highlighter *Highlighter) Save(file string) error {
+	data, err := json.MarshalIndent(highlighter.Rules(), "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0600)
+}
+
+// Flag a chat message matching a highlight rule, returning the separate event
+// to send for notifications, or nil when the message is not highlighted
+func (channel *IrcChannel) highlight(ev *ChatEvent) *ChatEvent {
+	if channel.Highlights == nil {
+		return nil
+	}
+	kind, ok := channel.Highlights.Match(ev, channel.username())
+	if !ok {
+		return nil
+	}
+	ev.Highlight = kind
+
+	notification := channel.newEvent(EventHighlight, nil)
+	notification.Kind = kind
+	notification.User = ev.User
+	notification.Text = ev.Text
+	notification.Target = ev.Tags["id"]
+	notification.Tags = ev.Tags
+	return notification
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types worth keeping in the history, state updates and acks are not
+var historyEventTypes = map[string]bool{
+	EventPrivMsg:    true,
+	EventUserNotice: true,
+	EventClearChat:  true,
+	EventClearMsg:   true,
+	EventNotice:     true,
+	EventWhisper:    true,
+}
+
+// Channel and login names twitch allows. Only these are used as log file
+// names, so a name from an RPC cannot lead out of the log directory.
+var chatNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// Check the name of a channel (#name) or whisper thread (@login)
+func validHistoryKey(key string) error {
+	if (!strings.HasPrefix(key, "#") && !strings.HasPrefix(key, "@")) || !chatNamePattern.MatchString(key[1:]) {
+		return fmt.Errorf("Invalid channel name: %s", key)
+	}
+	return nil
+}
+
+// Recent events of every channel, optionally logged to disk as json lines
+type ChatHistory struct {
+	size   int
+	logDir string
+	rings  map[string]*historyRing
+	files  map[string]*os.File
+	lock   sync.Mutex
+}
+
+// Fixed size buffer of a channel's latest events
+type historyRing struct {
+	events []*ChatEvent
+	next   int
+	full   bool
+}
+
+// Create a history keeping size events per channel in memory. If logDir is
+// not empty every event is also appended to <logDir>/<channel>.jsonl.
+func NewChatHistory(size int, logDir string) *ChatHistory {
+	history := new(ChatHistory)
+	history.size = size
+	history.logDir = logDir
+	history.rings = make(map[string]*historyRing)
+	history.files = make(map[string]*os.File)
+
+	if logDir != "" {
+		if err := os.MkdirAll(logDir, 0700); err != nil {
+			log.Print("Could not create chat log directory: ", err)
+			history.logDir = ""
+		}
+	}
+	return history
+}
+
+// Record an event
+func (history *ChatHistory) Add(ev *ChatEvent) {
+	key := historyKey(ev)
+	if !historyEventTypes[ev.Type] || key == "" {
+		return
+	}
+
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	ring, ok := history.rings[key]
+	if !ok {
+		ring = &historyRing{events: make([]*ChatEvent, history.size)}
+		history.rings[key] = ring
+	}
+	ring.add(ev)
+
+	if history.logDir != "" {
+		history.appendLog(key, ev)
+	}
+}
+
+// Name an event is stored under, its channel or @login for whisper threads
+func historyKey(ev *ChatEvent) string {
+	if ev.Type == EventWhisper {
+		if ev.Thread == "" {
+			return ""
+		}
+		return whisperThread(ev.Thread)
+	}
+	return ev.Channel
+}
+
+// Return the last limit events of a channel, oldest first
+func (history *ChatHistory) Recent(channel string, limit int) []*ChatEvent {
+	return history.Before(channel, time.Time{}, limit)
+}
+
+// Return the last limit events of a channel sent before the given time, oldest
+// first. A zero time means now. The events held in memory are used first; when
+// they are not enough the on-disk log, if enabled, is read from its end for
+// older ones.
+func (history *ChatHistory) Before(channel string, before time.Time, limit int) []*ChatEvent {
+	if limit <= 0 {
+		limit = history.size
+	}
+	if validHistoryKey(channel) != nil {
+		return nil
+	}
+
+	history.lock.Lock()
+	logDir := history.logDir
+	var events []*ChatEvent
+	if ring, ok := history.rings[channel]; ok {
+		events = ring.list()
+	}
+	history.lock.Unlock()
+
+	var result []*ChatEvent
+	for _, ev := range events {
+		if before.IsZero() || ev.Time.Before(before) {
+			result = append(result, ev)
+		}
+	}
+	if len(result) > limit {
+		return result[len(result)-limit:]
+	}
+	if logDir == "" || len(result) == limit {
+		return result
+	}
+
+	// The log also holds the events in memory, only older ones are wanted
+	cutoff := before
+	if len(result) > 0 {
+		cutoff = result[0].Time
+	}
+	var older []*ChatEvent
+	file, _ := history.logPath(channel)
+	readChatLogBackwards(file, 0, func(ev *ChatEvent) bool {
+		if cutoff.IsZero() || ev.Time.Before(cutoff) {
+			older = append(older, ev)
+		}
+		return len(older)+len(result) < limit
+	})
+	for i, j := 0, len(older)-1; i < j; i, j = i+1, j-1 {
+		older[i], older[j] = older[j], older[i]
+	}
+	return append(older, result...)
+}
+
+// Every stored event of a channel accepted by the filter, oldest first. The
+// log is read when it is enabled, otherwise only the in-memory events are used.
+func (history *ChatHistory) Matching(channel string, filter func(ev *ChatEvent) bool) []*ChatEvent {
+	file, err := history.logPath(channel)
+	if err != nil {
+		return nil
+	}
+	if history.logDir != "" {
+		if logged, err := readChatLog(file, filter); err == nil {
+			return logged
+		}
+	}
+
+	var events []*ChatEvent
+	for _, ev := range history.Recent(channel, 0) {
+		if filter == nil || filter(ev) {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// Close the open log files
+func (history *ChatHistory) Close() {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	for channel, file := range history.files {
+		file.Close()
+		delete(history.files, channel)
+	}
+}
+
+// The log file of a channel, or of a whisper thread kept as @login.jsonl
+func (history *ChatHistory) logPath(channel string) (string, error) {
+	if err := validHistoryKey(channel); err != nil {
+		return "", err
+	}
+	return path.Join(history.logDir, strings.TrimPrefix(channel, "#")+".jsonl"), nil
+}
+
+// Append an event to the log of the channel or thread it is stored under, the history lock must be held
+func (history *ChatHistory) appendLog(key string, ev *ChatEvent) {
+	file, ok := history.files[key]
+	if !ok {
+		name, err := history.logPath(key)
+		if err != nil {
+			log.Print("Not logging chat: ", err)
+			return
+		}
+		file, err = os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Print("Could not open chat log: ", err)
+			return
+		}
+		history.files[key] = file
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		log.Print("Could not write chat log: ", err)
+	}
+}
+
+// Read every event of a log file accepted by the filter, which may be nil
+func readChatLog(file string, filter func(ev *ChatEvent) bool) ([]*ChatEvent, error) {
+	handle, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	var events []*ChatEvent
+	scanner := bufio.NewScanner(handle)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		ev := new(ChatEvent)
+		if err := json.Unmarshal(scanner.Bytes(), ev); err != nil {
+			continue
+		}
+		if filter == nil || filter(ev) {
+			events = append(events, ev)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// Call fn with the events of a log file, newest first, until it returns false
+// or maxBytes were read, 0 reading all of it. The file is read in chunks from
+// its end, so recent events are found without reading all of it. Returns how
+// many bytes were read.
+func readChatLogBackwards(file string, maxBytes int64, fn func(ev *ChatEvent) bool) (int64, error) {
+	handle, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer handle.Close()
+	info, err := handle.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// Decode a line, telling whether to go on
+	decode := func(line []byte) bool {
+		ev := new(ChatEvent)
+		if len(line) == 0 || json.Unmarshal(line, ev) != nil {
+			return true
+		}
+		return fn(ev)
+	}
+
+	chunk := make([]byte, 64*1024)
+	var partial []byte // Start of the file's next line, which began before the chunk
+	var read int64
+	for offset := info.Size(); offset > 0; {
+		if maxBytes > 0 && read >= maxBytes {
+			return read, nil
+		}
+		size := int64(len(chunk))
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		if _, err := handle.ReadAt(chunk[:size], offset); err != nil {
+			return read, err
+		}
+		read += size
+		lines := bytes.Split(append(append([]byte(nil), chunk[:size]...), partial...), []byte("\n"))
+		partial = lines[0]
+		for i := len(lines) - 1; i > 0; i-- {
+			if !decode(lines[i]) {
+				return read, nil
+			}
+		}
+	}
+	decode(partial)
+	return read, nil
+}
+
+func (ring *historyRing) add(ev *ChatEvent) {
+	if len(ring.events) == 0 {
+		return
+	}
+	ring.events[ring.next] = ev
+	ring.next = (ring.next + 1) % len(ring.events)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+// Events in the ring, oldest first
+func (ring *historyRing) list() []*ChatEvent {
+	if !ring.full {
+		return append([]*ChatEvent(nil), ring.events[:ring.next]...)
+	}
+	return append(append([]*ChatEvent(nil), ring.events[ring.next:]...), ring.events[:ring.next]...)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChatHistory(t *testing.T) {
+	Convey("Test the in-memory chat history", t, func() {
+		history := NewChatHistory(3, "")
+		start := time.Now()
+		for i, text := range []string{"one", "two", "three", "four"} {
+			history.Add(&ChatEvent{Type: EventPrivMsg, Channel: "#test_channel", Text: text, Time: start.Add(time.Duration(i) * time.Second)})
+		}
+		history.Add(&ChatEvent{Type: EventUserState, Channel: "#test_channel", Time: start})
+
+		Convey("Only the latest events are kept, oldest first", func() {
+			events := history.Recent("#test_channel", 0)
+			So(len(events), ShouldEqual, 3)
+			So(events[0].Text, ShouldEqual, "two")
+			So(events[2].Text, ShouldEqual, "four")
+		})
+		Convey("Events can be paged backwards", func() {
+			events := history.Before("#test_channel", start.Add(3*time.Second), 1)
+			So(len(events), ShouldEqual, 1)
+			So(events[0].Text, ShouldEqual, "three")
+		})
+	})
+
+	Convey("Test the on-disk chat log", t, func() {
+		dir, err := ioutil.TempDir("", "twicciand")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		history := NewChatHistory(1, dir)
+		history.Add(&ChatEvent{Type: EventPrivMsg, Channel: "#test_channel", Text: "one", Time: time.Now()})
+		history.Add(&ChatEvent{Type: EventPrivMsg, Channel: "#test_channel", Text: "two", Time: time.Now()})
+		history.Close()
+
+		Convey("Events older than the ring are read from the log", func() {
+			events := history.Recent("#test_channel", 10)
+			So(len(events), ShouldEqual, 2)
+			So(events[0].Text, ShouldEqual, "one")
+			So(events[1].Text, ShouldEqual, "two")
+		})
+		Convey("Only as much of the log is read as needed", func() {
+			history.Add(&ChatEvent{Type: EventPrivMsg, Channel: "#test_channel", Text: "three", Time: time.Now()})
+			events := history.Recent("#test_channel", 2)
+			So(len(events), ShouldEqual, 2)
+			So(events[0].Text, ShouldEqual, "two")
+			So(events[1].Text, ShouldEqual, "three")
+		})
+		Convey("Lines split between the chunks of a long log are read whole", func() {
+			start := time.Now()
+			for i := 0; i < 3000; i++ {
+				history.Add(&ChatEvent{Type: EventPrivMsg, Channel: "#test_channel", Text: strconv.Itoa(i), Time: start.Add(time.Duration(i) * time.Millisecond)})
+			}
+			events := history.Before("#test_channel", start.Add(2000*time.Millisecond), 1500)
+			So(len(events), ShouldEqual, 1500)
+			So(events[0].Text, ShouldEqual, "500")
+			So(events[1499].Text, ShouldEqual, "1999")
+		})
+		Convey("Names which are not twitch's cannot reach outside the log directory", func() {
+			_, err := history.logPath("#../../x")
+			So(err, ShouldNotBeNil)
+			So(history.Recent("#../test_channel", 10), ShouldBeEmpty)
+			So(history.Matching("@../x", nil), ShouldBeEmpty)
+		})
+	})
+}
+
+func TestChatSearch(t *testing.T) {
+	Convey("Test searching the chat history", t, func() {
+		history := NewChatHistory(10, "")
+		start := time.Now()
+		history.Add(&ChatEvent{Type: EventPrivMsg, Channel: "#one", User: "alice", Text: "Hello everyone", Time: start, Tags: map[string]string{"badges": "moderator/1"}})
+		history.Add(&ChatEvent{Type: EventPrivMsg, Channel: "#two", User: "alice", Text: "hello again", Time: start.Add(time.Second)})
+		history.Add(&ChatEvent{Type: EventPrivMsg, Channel: "#two", User: "bob", Text: "helicopter", Time: start.Add(2 * time.Second)})
+
+		Convey("A user is found across channels, newest first", func() {
+			result := history.Search(&ChatSearch{User: "Alice"})
+			So(result.Total, ShouldEqual, 2)
+			So(result.Events[0].Channel, ShouldEqual, "#two")
+		})
+		Convey("Words match whole words unless a prefix is asked for", func() {
+			So(history.Search(&ChatSearch{Text: "hel"}).Total, ShouldEqual, 0)
+			So(history.Search(&ChatSearch{Text: "hel*"}).Total, ShouldEqual, 3)
+			So(history.Search(&ChatSearch{Text: "hello again"}).Total, ShouldEqual, 1)
+		})
+		Convey("Badges and pages are applied", func() {
+			So(history.Search(&ChatSearch{Badges: []string{"moderator"}}).Total, ShouldEqual, 1)
+			result := history.Search(&ChatSearch{Offset: 2, Limit: 2})
+			So(len(result.Events), ShouldEqual, 1)
+			So(result.Events[0].User, ShouldEqual, "alice")
+		})
+	})
+
+	Convey("Test searching the on-disk chat log", t, func() {
+		dir, err := ioutil.TempDir("", "twicciand")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		history := NewChatHistory(1, dir)
+		start := time.Now().Add(-time.Hour)
+		for i := 0; i < 3000; i++ {
+			history.Add(&ChatEvent{Type: EventPrivMsg, Channel: "#test_channel", User: "alice", Text: strconv.Itoa(i), Time: start.Add(time.Duration(i) * time.Millisecond)})
+		}
+		history.Close()
+
+		Convey("Reading stops once the page is filled", func() {
+			result := history.Search(&ChatSearch{User: "alice", Limit: 10})
+			So(result.Partial, ShouldBeTrue)
+			So(result.Total, ShouldEqual, 10)
+			So(result.Events[0].Text, ShouldEqual, "2999")
+		})
+		Convey("Reading stops at the start of the time range", func() {
+			result := history.Search(&ChatSearch{Since: start.Add(2990 * time.Millisecond)})
+			So(result.Partial, ShouldBeFalse)
+			So(result.Total, ShouldEqual, 10)
+		})
+		Convey("A log last written before the time range is not read", func() {
+			So(history.Search(&ChatSearch{Since: time.Now().Add(time.Hour)}).Total, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestChatExport(t *testing.T) {
+	Convey("Test exporting through the RPC", t, func() {
+		start := time.Now()
+		chat := &TwitchChat{history: NewChatHistory(10, "")}
+		chat.history.Add(&ChatEvent{Type: EventPrivMsg, Channel: "#test_channel", User: "alice", Text: "hi", Time: start})
+		api := NewLocalApi("", nil, chat)
+
+		Convey("A failed export is an error result", func() {
+			result := api.exportChat([]byte(`{"channel":""}`))
+			So(result.String(), ShouldContainSubstring, `"error":"No channel to export"`)
+		})
+		Convey("An offset of zero is kept", func() {
+			params, _ := json.Marshal(&ChatExport{Channel: "test_channel", Format: "jsonl", StreamStart: start})
+			result := api.exportChat(params)
+			So(result.String(), ShouldContainSubstring, `\"offset\":0`)
+		})
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events queued for a client before it is considered lagging
+const clientQueueSize = 256
+
+// A lagging client is dropped once it missed this many events
+const maxDroppedEvents = 4 * clientQueueSize
+
+// Delivers chat events to every connected websocket and RPC client
+type ChatHub struct {
+	subscribers map[*ChatSubscriber]bool
+	lock        sync.Mutex
+}
+
+// A client of the hub, with its own queue of events
+type ChatSubscriber struct {
+	Events   chan *ChatEvent
+	channels map[string]bool // Channels the client wants, all of them when empty
+	dropped  int             // Events missed since the client started lagging
+	closed   bool
+}
+
+func NewChatHub() *ChatHub {
+	hub := new(ChatHub)
+	hub.subscribers = make(map[*ChatSubscriber]bool)
+	return hub
+}
+
+// Add a client interested in the given channels, or every channel if there are none
+func (hub *ChatHub) Subscribe(channels []string) *ChatSubscriber {
+	sub := new(ChatSubscriber)
+	sub.Events = make(chan *ChatEvent, clientQueueSize)
+	sub.channels = make(map[string]bool)
+	for _, channel := range channels {
+		if channel != "" {
+			sub.channels[channelName(channel)] = true
+		}
+	}
+
+	hub.lock.Lock()
+	hub.subscribers[sub] = true
+	hub.lock.Unlock()
+	return sub
+}
+
+// Remove a client, closing its queue
+func (hub *ChatHub) Unsubscribe(sub *ChatSubscriber) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	hub.remove(sub)
+}
+
+// Queue an event for every interested client without ever blocking. Clients
+// with a full queue miss the event and are told how many they missed once
+// they catch up, clients which keep falling behind are dropped.
+func (hub *ChatHub) Broadcast(ev *ChatEvent) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	for sub := range hub.subscribers {
+		if !sub.Wants(ev) {
+			continue
+		}
+		if sub.dropped > 0 && len(sub.Events) < cap(sub.Events)-1 {
+			// There is room again, tell the client what it missed first
+			sub.Events <- &ChatEvent{Type: EventLagged, Channel: ev.Channel, Time: time.Now(), Dropped: sub.dropped}
+			sub.dropped = 0
+		}
+		select {
+		case sub.Events <- ev:
+		default:
+			sub.dropped++
+			if sub.dropped > maxDroppedEvents {
+				hub.remove(sub)
+			}
+		}
+	}
+}
+
+// Check if the client wants an event, events without a channel go to everyone
+func (sub *ChatSubscriber) Wants(ev *ChatEvent) bool {
+	return len(sub.channels) == 0 || ev.Channel == "" || sub.channels[strings.ToLower(ev.Channel)]
+}
+
+// Remove a client, the hub lock must be held
+func (hub *ChatHub) remove(sub *ChatSubscriber) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(hub.subscribers, sub)
+	close(sub.Events)
+}
+
+// Move a channel's events to the hub until the channel is disconnected
+func (chat *TwitchChat) pump(channel *IrcChannel) {
+	for ev := range channel.ReadFromChannel {
+		chat.hub.Broadcast(ev)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChatHub(t *testing.T) {
+	Convey("Test delivering chat events to clients", t, func() {
+		hub := NewChatHub()
+		all := hub.Subscribe(nil)
+		one := hub.Subscribe([]string{"One", ""})
+
+		Convey("Events go to every client", func() {
+			ev := &ChatEvent{Type: EventPrivMsg, Channel: "#one", Time: time.Now()}
+			hub.Broadcast(ev)
+			So(<-all.Events, ShouldEqual, ev)
+			So(<-one.Events, ShouldEqual, ev)
+		})
+		Convey("Clients only get the channels they asked for", func() {
+			hub.Broadcast(&ChatEvent{Type: EventPrivMsg, Channel: "#two"})
+			So(all.Events, ShouldHaveLength, 1)
+			So(one.Events, ShouldBeEmpty)
+
+			// Events of no channel in particular are for everyone
+			hub.Broadcast(&ChatEvent{Type: EventSession})
+			So(one.Events, ShouldHaveLength, 1)
+		})
+		Convey("A client left gets nothing more", func() {
+			hub.Unsubscribe(one)
+			hub.Broadcast(&ChatEvent{Type: EventPrivMsg, Channel: "#one"})
+			_, open := <-one.Events
+			So(open, ShouldBeFalse)
+			So(all.Events, ShouldHaveLength, 1)
+			So(func() { hub.Unsubscribe(one) }, ShouldNotPanic)
+		})
+		Convey("A lagging client is told how many events it missed", func() {
+			for i := 0; i < clientQueueSize+3; i++ {
+				hub.Broadcast(&ChatEvent{Type: EventPrivMsg, Channel: "#one"})
+			}
+			So(one.dropped, ShouldEqual, 3)
+			for len(one.Events) > 0 {
+				<-one.Events
+			}
+
+			next := &ChatEvent{Type: EventPrivMsg, Channel: "#one"}
+			hub.Broadcast(next)
+			lagged := <-one.Events
+			So(lagged.Type, ShouldEqual, EventLagged)
+			So(lagged.Dropped, ShouldEqual, 3)
+			So(<-one.Events, ShouldEqual, next)
+		})
+		Convey("A client which keeps lagging is dropped", func() {
+			for i := 0; i < clientQueueSize+maxDroppedEvents+1; i++ {
+				hub.Broadcast(&ChatEvent{Type: EventPrivMsg, Channel: "#two"})
+			}
+			So(hub.subscribers[all], ShouldBeFalse)
+			So(hub.subscribers[one], ShouldBeTrue)
+			for range all.Events {
+			}
+			So(all.closed, ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Twitch's limits on how many messages an account may send, and channels it may join
+const (
+	sendWindow        = 30 * time.Second
+	sendLimitNormal   = 20
+	sendLimitMod      = 100
+	sendLimitVerified = 7500
+	joinWindow        = 10 * time.Second
+	joinLimit         = 20
+	duplicateWindow   = 30 * time.Second
+)
+
+// Appended to a message to get it past twitch's duplicate message rule
+const duplicateSuffix = " \U000E0000"
+
+// Sliding window rate limiter
+type RateLimiter struct {
+	window time.Duration
+	sent   []time.Time
+	lock   sync.Mutex
+}
+
+func NewRateLimiter(window time.Duration) *RateLimiter {
+	limiter := new(RateLimiter)
+	limiter.window = window
+	return limiter
+}
+
+// Block until one more action fits in the window, when limit actions are allowed per window
+func (limiter *RateLimiter) Wait(limit int) {
+	for {
+		limiter.lock.Lock()
+		now := time.Now()
+		for len(limiter.sent) > 0 && now.Sub(limiter.sent[0]) >= limiter.window {
+			limiter.sent = limiter.sent[1:]
+		}
+		if len(limiter.sent) < limit {
+			limiter.sent = append(limiter.sent, now)
+			limiter.lock.Unlock()
+			return
+		}
+		// Wait for enough old actions to leave the window, without keeping
+		// callers with a higher limit waiting
+		wait := limiter.sent[len(limiter.sent)-limit].Add(limiter.window).Sub(now)
+		limiter.lock.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// Rate limits shared by every chat connection of an account
+type ChatLimits struct {
+	Send     *RateLimiter
+	Join     *RateLimiter
+	verified int32 // Verified bots get a much higher message limit
+}
+
+func NewChatLimits() *ChatLimits {
+	limits := new(ChatLimits)
+	limits.Send = NewRateLimiter(sendWindow)
+	limits.Join = NewRateLimiter(joinWindow)
+	return limits
+}
+
+// Set whether the account is a verified bot, which can change while sending
+func (limits *ChatLimits) SetVerified(verified bool) {
+	value := int32(0)
+	if verified {
+		value = 1
+	}
+	atomic.StoreInt32(&limits.verified, value)
+}
+
+func (limits *ChatLimits) Verified() bool {
+	return atomic.LoadInt32(&limits.verified) == 1
+}
+
+// Block until a message may be sent, moderators of the channel get a higher limit
+func (limits *ChatLimits) WaitSend(mod bool) {
+	if limits.Verified() {
+		limits.Send.Wait(sendLimitVerified)
+	} else if mod {
+		limits.Send.Wait(sendLimitMod)
+	} else {
+		limits.Send.Wait(sendLimitNormal)
+	}
+}
+
+// Block until a channel may be joined
+func (limits *ChatLimits) WaitJoin() {
+	limits.Join.Wait(joinLimit)
+}
+
+// Check if USERSTATE says we are a moderator (or the broadcaster) of the channel
+func (channel *IrcChannel) isModerator() bool {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
+	if channel.UserState["mod"] == "1" {
+		return true
+	}
+	for _, badge := range strings.Split(channel.UserState["badges"], ",") {
+		if strings.HasPrefix(badge, "broadcaster/") || strings.HasPrefix(badge, "moderator/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Twitch drops a message identical to the previous one sent within 30 seconds,
+// so alternate an invisible suffix to make repeated messages differ
+func (channel *IrcChannel) dedupe(text string) string {
+	now := time.Now()
+	if text == channel.lastSentText && now.Sub(channel.lastSentTime) < duplicateWindow {
+		if !strings.HasSuffix(channel.lastSent, duplicateSuffix) {
+			text += duplicateSuffix
+		}
+	}
+	channel.lastSentText = strings.TrimSuffix(text, duplicateSuffix)
+	channel.lastSent = text
+	channel.lastSentTime = now
+	return text
+}
+
+// Number of messages waiting to be sent to the channel
+func (channel *IrcChannel) QueueDepth() int {
+	return len(channel.PostToChannel)
+}
+
+// Tell clients how many messages are still waiting, while there is a backlog
+func (channel *IrcChannel) emitQueueDepth() {
+	depth := channel.QueueDepth()
+	if depth == 0 && channel.lastDepth == 0 {
+		return
+	}
+	channel.lastDepth = depth
+
+	ev := channel.newEvent(EventQueue, nil)
+	ev.Queued = depth
+	channel.emit(ev)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/sorcix/irc"
+)
+
+// How long the next action had to wait, once limit actions used up the window
+func waitAfterFilling(limit int, wait func()) time.Duration {
+	for i := 0; i < limit; i++ {
+		wait()
+	}
+	start := time.Now()
+	wait()
+	return time.Since(start)
+}
+
+func TestRateLimiter(t *testing.T) {
+	window := 50 * time.Millisecond
+
+	Convey("Test the sliding window", t, func() {
+		for _, limit := range []int{1, 2, 5} {
+			limiter := NewRateLimiter(window)
+			waited := waitAfterFilling(limit, func() { limiter.Wait(limit) })
+			So(waited, ShouldBeGreaterThanOrEqualTo, window/2)
+		}
+
+		Convey("Actions within the limit do not wait", func() {
+			limiter := NewRateLimiter(time.Hour)
+			start := time.Now()
+			for i := 0; i < 5; i++ {
+				limiter.Wait(5)
+			}
+			So(time.Since(start), ShouldBeLessThan, window)
+		})
+		Convey("A waiting caller does not hold up one with a higher limit", func() {
+			limiter := NewRateLimiter(time.Hour)
+			limiter.Wait(1)
+			go limiter.Wait(1)
+			time.Sleep(10 * time.Millisecond)
+
+			done := make(chan bool)
+			go func() {
+				limiter.Wait(5)
+				done <- true
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Error("Wait with a higher limit was blocked")
+			}
+		})
+	})
+
+	Convey("Test the chat limits of an account", t, func() {
+		tests := []struct {
+			verified bool
+			mod      bool
+			limit    int
+		}{
+			{false, false, sendLimitNormal},
+			{false, true, sendLimitMod},
+			{true, false, sendLimitVerified},
+			{true, true, sendLimitVerified},
+		}
+		for _, test := range tests {
+			limits := NewChatLimits()
+			limits.Send = NewRateLimiter(window)
+			limits.SetVerified(test.verified)
+			So(limits.Verified(), ShouldEqual, test.verified)
+			waited := waitAfterFilling(test.limit, func() { limits.WaitSend(test.mod) })
+			So(waited, ShouldBeGreaterThanOrEqualTo, window/2)
+		}
+
+		Convey("Joins have a limit of their own", func() {
+			limits := NewChatLimits()
+			limits.Join = NewRateLimiter(window)
+			So(waitAfterFilling(joinLimit, limits.WaitJoin), ShouldBeGreaterThanOrEqualTo, window/2)
+		})
+		Convey("Waiting for a join does not hold up the connection", func() {
+			limits := NewChatLimits()
+			limits.Join = NewRateLimiter(time.Hour)
+			for i := 0; i < joinLimit; i++ {
+				limits.WaitJoin()
+			}
+			channel := newTestChannel()
+			channel.Config.Limits = limits
+			channel.done = make(chan struct{})
+			defer close(channel.done)
+
+			start := time.Now()
+			channel.handleConnect(&irc.Message{Command: irc.RPL_WELCOME})
+			So(time.Since(start), ShouldBeLessThan, window)
+		})
+	})
+}
+
+func TestChatDedupe(t *testing.T) {
+	Convey("Test getting repeated messages past twitch's duplicate rule", t, func() {
+		channel := newTestChannel()
+		tests := []struct {
+			text string
+			sent string
+		}{
+			{"hello", "hello"},
+			{"hello", "hello" + duplicateSuffix},
+			{"hello", "hello"},
+			{"hello", "hello" + duplicateSuffix},
+			{"something else", "something else"},
+			{"hello", "hello"},
+		}
+		for _, test := range tests {
+			So(channel.dedupe(test.text), ShouldEqual, test.sent)
+		}
+
+		Convey("A message repeated after the window is sent as is", func() {
+			channel.lastSentTime = time.Now().Add(-duplicateWindow)
+			So(channel.dedupe("hello"), ShouldEqual, "hello")
+		})
+	})
+}
+
+func TestChatQueueDepth(t *testing.T) {
+	Convey("Test reporting the messages waiting to be sent", t, func() {
+		channel := newTestChannel()
+		channel.PostToChannel = make(chan *OutgoingMsg, 4)
+		channel.PostToChannel <- newOutgoingText("one")
+		channel.PostToChannel <- newOutgoingText("two")
+
+		tests := []struct {
+			queued int
+			event  bool
+		}{
+			{2, true},
+			{1, true},
+			{0, true},
+			{0, false},
+		}
+		for i, test := range tests {
+			if i > 0 && len(channel.PostToChannel) > 0 {
+				<-channel.PostToChannel
+			}
+			channel.emitQueueDepth()
+			if !test.event {
+				So(channel.ReadFromChannel, ShouldBeEmpty)
+				continue
+			}
+			ev := <-channel.ReadFromChannel
+			So(ev.Type, ShouldEqual, EventQueue)
+			So(ev.Queued, ShouldEqual, test.queued)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Default and maximum number of results per page
+const (
+	searchDefaultLimit = 50
+	searchMaxLimit     = 500
+)
+
+// Most bytes of chat log a search reads, over all channels
+const searchMaxScan = 64 * 1024 * 1024
+
+// Filters of a chat search, empty fields match everything
+type ChatSearch struct {
+	Channel string    `json:"channel"`
+	User    string    `json:"user"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Text    string    `json:"text"`   // Words which must all appear, "word*" matches a prefix
+	Badges  []string  `json:"badges"` // Badges the user must have, eg. moderator or subscriber
+	Types   []string  `json:"types"`  // Event types, eg. privmsg or usernotice
+	Offset  int       `json:"offset"`
+	Limit   int       `json:"limit"`
+}
+
+// One page of search results, newest first. The search stops reading once a
+// channel gave enough matches for the page, or after searchMaxScan bytes of
+// log; Partial is then set and Total only counts the matches found.
+type ChatSearchResult struct {
+	Total   int          `json:"total"`
+	Partial bool         `json:"partial"`
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+	Events  []*ChatEvent `json:"events"`
+}
+
+// Search the chat log, or the in-memory history when logging is disabled
+func (history *ChatHistory) Search(query *ChatSearch) *ChatSearchResult {
+	result := new(ChatSearchResult)
+	result.Offset = query.Offset
+	result.Limit = query.Limit
+	if result.Limit <= 0 {
+		result.Limit = searchDefaultLimit
+	} else if result.Limit > searchMaxLimit {
+		result.Limit = searchMaxLimit
+	}
+	if result.Offset < 0 {
+		result.Offset = 0
+	}
+
+	// No channel can add more than a page and what comes before it
+	wanted := result.Offset + result.Limit
+	terms := tokenize(query.Text)
+	budget := int64(searchMaxScan)
+	var events []*ChatEvent
+	for _, channel := range history.searchChannels(query.Channel) {
+		found, complete := history.searchChannel(channel, query, terms, wanted, &budget)
+		events = append(events, found...)
+		if !complete {
+			result.Partial = true
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+
+	result.Total = len(events)
+	result.Events = []*ChatEvent{}
+	if result.Offset < len(events) {
+		end := result.Offset + result.Limit
+		if end > len(events) {
+			end = len(events)
+		}
+		result.Events = events[result.Offset:end]
+	}
+	return result
+}
+
+// The newest wanted matches of a channel, newest first. Reading the log takes
+// from budget; tells whether every stored event of the channel was looked at.
+func (history *ChatHistory) searchChannel(channel string, query *ChatSearch, terms []string, wanted int, budget *int64) ([]*ChatEvent, bool) {
+	file, err := history.logPath(channel)
+	if err != nil {
+		return nil, true
+	}
+	history.lock.Lock()
+	logDir := history.logDir
+	history.lock.Unlock()
+
+	var found []*ChatEvent
+	complete := true
+	// The log is in time order, so reading from its end stops at the first
+	// event before Since, and a log last written before Since is skipped
+	match := func(ev *ChatEvent) bool {
+		if !query.Since.IsZero() && ev.Time.Before(query.Since) {
+			return false
+		}
+		if query.matches(ev, terms) {
+			found = append(found, ev)
+			if len(found) == wanted {
+				complete = false
+				return false
+			}
+		}
+		return true
+	}
+
+	if info, err := os.Stat(file); logDir != "" && err == nil {
+		if !query.Since.IsZero() && info.ModTime().Before(query.Since) {
+			return nil, true
+		}
+		if *budget <= 0 {
+			return nil, false
+		}
+		read, err := readChatLogBackwards(file, *budget, match)
+		*budget -= read
+		if err == nil {
+			return found, complete && *budget > 0
+		}
+		found, complete = nil, true
+	}
+
+	events := history.Recent(channel, 0)
+	for i := len(events) - 1; i >= 0; i-- {
+		if !match(events[i]) {
+			break
+		}
+	}
+	return found, complete
+}
+
+// Channels to search, every channel we have history of when none is given
+func (history *ChatHistory) searchChannels(channel string) []string {
+	if strings.HasPrefix(channel, "@") {
+		return []string{whisperThread(channel)}
+	} else if channel != "" {
+		return []string{channelName(channel)}
+	}
+
+	seen := make(map[string]bool)
+	history.lock.Lock()
+	for name := range history.rings {
+		seen[name] = true
+	}
+	logDir := history.logDir
+	history.lock.Unlock()
+
+	if logDir != "" {
+		files, _ := ioutil.ReadDir(logDir)
+		for _, file := range files {
+			name := strings.TrimSuffix(file.Name(), ".jsonl")
+			if name == file.Name() {
+				continue
+			}
+			if !strings.HasPrefix(name, "@") {
+				name = "#" + name
+			}
+			seen[name] = true
+		}
+	}
+
+	channels := make([]string, 0, len(seen))
+	for name := range seen {
+		channels = append(channels, name)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Check an event against every filter of the search
+func (query *ChatSearch) matches(ev *ChatEvent, terms []string) bool {
+	if query.User != "" && !strings.EqualFold(query.User, ev.User) {
+		return false
+	}
+	if !query.Since.IsZero() && ev.Time.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !ev.Time.Before(query.Until) {
+		return false
+	}
+	if len(query.Types) > 0 && !containsString(query.Types, ev.Type) {
+		return false
+	}
+	if len(query.Badges) > 0 {
+		badges := eventBadges(ev)
+		for _, badge := range query.Badges {
+			if !badges[strings.ToLower(badge)] {
+				return false
+			}
+		}
+	}
+	if len(terms) > 0 {
+		words := tokenize(ev.Text)
+		for _, term := range terms {
+			if !containsWord(words, term) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Names of the badges in an event's tags, "moderator/1,subscriber/12" gives moderator and subscriber
+func eventBadges(ev *ChatEvent) map[string]bool {
+	badges := make(map[string]bool)
+	for _, badge := range strings.Split(ev.Tags["badges"], ",") {
+		if name := strings.SplitN(badge, "/", 2)[0]; name != "" {
+			badges[name] = true
+		}
+	}
+	return badges
+}
+
+// Split text into lowercase words, keeping a trailing * for prefix searches
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '*' && r != '_'
+	})
+}
+
+func containsWord(words []string, term string) bool {
+	prefix := strings.HasSuffix(term, "*")
+	term = strings.TrimRight(term, "*")
+	for _, word := range words {
+		if word == term || (prefix && strings.HasPrefix(word, term)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
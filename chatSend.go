@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How long we wait for twitch to accept or reject a message we sent
+const sendAckTimeout = 30 * time.Second
+
+// A message we sent to a channel, waiting for twitch to accept or reject it
+type OutgoingMsg struct {
+	Id      string    `json:"id"`
+	Text    string    `json:"text"`
+	Action  bool      `json:"-"` // Sent with /me
+	Command bool      `json:"-"` // A twitch command, which gets no USERSTATE answer
+	Sent    time.Time `json:"-"`
+}
+
+var outgoingMsgCount uint64
+
+// Create an outgoing message from what a websocket client sent. Clients can
+// either send plain text, or {"id": ..., "text": ...} to pick the id used in
+// the send_ack and send_failed events themselves.
+func NewOutgoingMsg(data []byte) *OutgoingMsg {
+	out := new(OutgoingMsg)
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, out); err != nil || out.Text == "" {
+			out = new(OutgoingMsg)
+		}
+	}
+	if out.Text == "" {
+		out.Text = string(data)
+	}
+	if out.Id == "" {
+		out.Id = nextOutgoingId()
+	}
+	return out
+}
+
+// Create an outgoing message from text produced by twicciand itself
+func newOutgoingText(text string) *OutgoingMsg {
+	out := new(OutgoingMsg)
+	out.Id = nextOutgoingId()
+	out.Text = text
+	return out
+}
+
+func nextOutgoingId() string {
+	return strconv.FormatUint(atomic.AddUint64(&outgoingMsgCount, 1), 10)
+}
+
+// The text actually sent to twitch for a message
+func (channel *IrcChannel) outgoingText(out *OutgoingMsg) string {
+	if out.Command {
+		return out.Text
+	}
+	text := channel.dedupe(out.Text)
+	if out.Action {
+		return "\x01ACTION " + text + "\x01"
+	}
+	return text
+}
+
+// Remember a message we are sending, so the next USERSTATE or msg_* NOTICE can be matched to it
+func (channel *IrcChannel) addPending(out *OutgoingMsg) {
+	out.Sent = time.Now()
+
+	channel.stateLock.Lock()
+	channel.pending = append(channel.pending, out)
+	channel.stateLock.Unlock()
+}
+
+// Report the messages twitch did not answer in time, called by Monitor.
+// Twitch answers every message, anything left this long was lost along the way.
+func (channel *IrcChannel) expirePending(now time.Time) {
+	channel.stateLock.Lock()
+	var expired []*OutgoingMsg
+	for len(channel.pending) > 0 && now.Sub(channel.pending[0].Sent) > sendAckTimeout {
+		expired = append(expired, channel.pending[0])
+		channel.pending = channel.pending[1:]
+	}
+	channel.stateLock.Unlock()
+
+	for _, out := range expired {
+		channel.emitSendFailed(out, "timeout", "No response from twitch")
+	}
+}
+
+// Stop waiting for an answer to a message which could not be sent
+func (channel *IrcChannel) removePending(out *OutgoingMsg) {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
+	for i, pending := range channel.pending {
+		if pending == out {
+			channel.pending = append(channel.pending[:i], channel.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Take the oldest message still waiting for an answer
+func (channel *IrcChannel) popPending() *OutgoingMsg {
+	channel.stateLock.Lock()
+	defer channel.stateLock.Unlock()
+	if len(channel.pending) == 0 {
+		return nil
+	}
+	out := channel.pending[0]
+	channel.pending = channel.pending[1:]
+	return out
+}
+
+// Twitch accepted a message: echo it with our own badges and color, then acknowledge it
+func (channel *IrcChannel) emitSendAck(out *OutgoingMsg) {
+	echo := channel.newEvent(EventPrivMsg, nil)
+	echo.User = channel.username()
+	// Kept in the form twitch sends /me messages of everyone else in
+	echo.Text = out.Text
+	if out.Action {
+		echo.Text = "\x01ACTION " + out.Text + "\x01"
+	}
+	echo.Html = channel.formatOwnMessage(echo.Text)
+	channel.emit(echo)
+
+	ack := channel.newEvent(EventSendAck, nil)
+	ack.Target = out.Id
+	ack.Text = out.Text
+	channel.emit(ack)
+}
+
+// Twitch rejected a message, kind is the msg-id of the notice explaining why
+func (channel *IrcChannel) emitSendFailed(out *OutgoingMsg, kind string, reason string) {
+	ev := channel.newEvent(EventSendFailed, nil)
+	ev.Target = out.Id
+	ev.Kind = kind
+	ev.Text = reason
+	channel.emit(ev)
+}
+
+// Notices with a msg_ id are twitch refusing the message we last sent
+func isRejectionNotice(msgId string) bool {
+	return strings.HasPrefix(msgId, "msg_")
+}
+
+// Render a message we sent the same way handlePrivMsg renders everyone else's
+func (channel *IrcChannel) formatOwnMessage(text string) string {
+	channel.stateLock.Lock()
+	state := channel.UserState
+	userId := channel.GlobalUserState["user-id"]
+	channel.stateLock.Unlock()
+	login := channel.username()
+
+	name := state["display-name"]
+	if name == "" {
+		name = login
+	}
+	sub := state["subscriber"]
+	if sub == "" {
+		sub = "0"
+	}
+	turbo := state["turbo"]
+	if turbo == "" {
+		turbo = "0"
+	}
+	color := channel.Colors.Color(userId, login, state["color"])
+
+	return "<span data-usertype='" + state["user-type"] + "' data-sub='" + sub + "' data-turbo='" + turbo +
+		"' style='color:" + color + "' id='username'><strong>" + html.EscapeString(name) + "</strong></span><span id='text'>: " + html.EscapeString(text) + " </span>"
+}
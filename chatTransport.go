@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Ways of reaching twitch's chat servers
+const (
+	TransportTLS       = "tls"       // irc over tls, the default
+	TransportTCP       = "tcp"       // plaintext irc, sends the token unencrypted
+	TransportWebsocket = "websocket" // irc lines in websocket messages, for networks blocking irc ports
+)
+
+// Default addresses of each transport
+var defaultChatServers = map[string]string{
+	TransportTLS:       "irc.chat.twitch.tv:6697",
+	TransportTCP:       "irc.chat.twitch.tv:6667",
+	TransportWebsocket: "wss://irc-ws.chat.twitch.tv:443",
+}
+
+// Where and how to connect to chat
+type ChatServer struct {
+	Address   string
+	Transport string
+	TLS       *tls.Config
+}
+
+// Create the settings for a chat server. An empty transport means tls, an
+// empty address the transport's default server. caFile adds a certificate
+// authority to trust and skipVerify accepts any certificate, which is only
+// meant for local test servers.
+func NewChatServer(transport string, address string, caFile string, skipVerify bool) (*ChatServer, error) {
+	server := new(ChatServer)
+	server.Transport = transport
+	if server.Transport == "" {
+		server.Transport = TransportTLS
+	}
+	if _, ok := defaultChatServers[server.Transport]; !ok {
+		return nil, fmt.Errorf("Unknown chat transport: %s", transport)
+	}
+	server.Address = address
+	if server.Address == "" {
+		server.Address = defaultChatServers[server.Transport]
+	}
+
+	server.TLS = &tls.Config{InsecureSkipVerify: skipVerify}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read chat CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+		server.TLS.RootCAs = pool
+	}
+	return server, nil
+}
+
+// Open a connection to the server, carrying plain irc lines whatever the transport
+func (server *ChatServer) Dial() (net.Conn, error) {
+	switch server.Transport {
+	case TransportTCP:
+		return net.Dial("tcp", server.Address)
+	case TransportWebsocket:
+		dialer := &websocket.Dialer{TLSClientConfig: server.TLS, HandshakeTimeout: 30 * time.Second}
+		conn, _, err := dialer.Dial(server.Address, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &wsIrcConn{Conn: conn}, nil
+	default:
+		return tls.Dial("tcp", server.Address, server.TLS)
+	}
+}
+
+// Presents twitch's websocket irc as a stream of lines, so the irc decoder
+// and encoder work on it unchanged. Each websocket message holds one or
+// more lines when reading, and exactly one line is sent per message.
+type wsIrcConn struct {
+	*websocket.Conn
+	reading []byte // Rest of the message being read
+	writing []byte // Partial line waiting for its line ending
+}
+
+func (conn *wsIrcConn) Read(p []byte) (int, error) {
+	for len(conn.reading) == 0 {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		conn.reading = msg
+		if !bytes.HasSuffix(msg, []byte("\n")) {
+			conn.reading = append(msg, '\r', '\n')
+		}
+	}
+	n := copy(p, conn.reading)
+	conn.reading = conn.reading[n:]
+	return n, nil
+}
+
+func (conn *wsIrcConn) Write(p []byte) (int, error) {
+	conn.writing = append(conn.writing, p...)
+	for {
+		end := bytes.IndexByte(conn.writing, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		line := bytes.TrimRight(conn.writing[:end], "\r")
+		if err := conn.WriteMessage(websocket.TextMessage, line); err != nil {
+			return 0, err
+		}
+		conn.writing = conn.writing[end+1:]
+	}
+}
+
+func (conn *wsIrcConn) SetDeadline(t time.Time) error {
+	if err := conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
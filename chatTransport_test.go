@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/sorcix/irc"
+)
+
+func TestChatTransport(t *testing.T) {
+	Convey("Test the chat server settings", t, func() {
+		server, err := NewChatServer("", "", "", false)
+		So(err, ShouldBeNil)
+		So(server.Transport, ShouldEqual, TransportTLS)
+		So(server.Address, ShouldEqual, "irc.chat.twitch.tv:6697")
+
+		_, err = NewChatServer("carrier-pigeon", "", "", false)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Test irc over websockets", t, func() {
+		// Answers every line with two lines in a single message, like twitch batches them
+		ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			conn, err := upgrader.Upgrade(w, req, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				conn.WriteMessage(websocket.TextMessage, []byte("PONG :"+string(msg)+"\r\nPING :again\r\n"))
+			}
+		}))
+		defer ws.Close()
+
+		server, err := NewChatServer(TransportWebsocket, "ws"+strings.TrimPrefix(ws.URL, "http"), "", false)
+		So(err, ShouldBeNil)
+		conn, err := server.Dial()
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		So(irc.NewEncoder(conn).Encode(&irc.Message{Command: irc.PING, Trailing: "hi"}), ShouldBeNil)
+		reader := irc.NewDecoder(conn)
+		pong, err := reader.Decode()
+		So(err, ShouldBeNil)
+		So(pong.Command, ShouldEqual, irc.PONG)
+		So(pong.Trailing, ShouldEqual, "PING :hi")
+		ping, err := reader.Decode()
+		So(err, ShouldBeNil)
+		So(ping.Trailing, ShouldEqual, "again")
+	})
+}
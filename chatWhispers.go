@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+// How many whisper ids are remembered to drop the copies other connections receive
+const whisperSeenSize = 256
+
+// Whispers are delivered to every connection of the account, so each one is only emitted once
+type Whispers struct {
+	seen  map[string]bool
+	order []string
+	lock  sync.Mutex
+}
+
+func NewWhispers() *Whispers {
+	whispers := new(Whispers)
+	whispers.seen = make(map[string]bool)
+	return whispers
+}
+
+// Check if a whisper was already received, remembering it if not
+func (whispers *Whispers) Seen(id string) bool {
+	if id == "" {
+		return false
+	}
+	whispers.lock.Lock()
+	defer whispers.lock.Unlock()
+	if whispers.seen[id] {
+		return true
+	}
+	whispers.seen[id] = true
+	whispers.order = append(whispers.order, id)
+	if len(whispers.order) > whisperSeenSize {
+		delete(whispers.seen, whispers.order[0])
+		whispers.order = whispers.order[1:]
+	}
+	return false
+}
+
+// Name of a whisper conversation in the history, @ followed by the other user's login
+func whisperThread(user string) string {
+	return "@" + strings.ToLower(strings.TrimPrefix(user, "@"))
+}
+
+// Handle a whisper sent to us, which does not belong to any channel
+func (channel *IrcChannel) handleWhisper(msg *irc.Message) {
+	if msg.Prefix == nil {
+		return
+	}
+	ev := channel.newEvent(EventWhisper, msg)
+	ev.Channel = ""
+	ev.User = msg.Prefix.Name
+	ev.Thread = msg.Prefix.Name
+	ev.Text = msg.Trailing
+	if channel.Whispers != nil && channel.Whispers.Seen(ev.Tags["message-id"]) {
+		return
+	}
+	if channel.Filters != nil {
+		var show bool
+		if ev.Text, show = channel.Filters.Apply(ev.User, ev.Tags["user-id"], ev.Text); !show {
+			return
+		}
+	}
+	channel.emit(ev)
+}
+
+// Whisper a user through any connected channel, whispers do not depend on the current one
+func (chat *TwitchChat) Whisper(user string, text string) error {
+	user = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(user), "@"))
+	if user == "" || strings.TrimSpace(text) == "" {
+		return fmt.Errorf("A whisper needs a user and a message")
+	}
+
+	channel := chat.Current()
+	if channels := chat.Channels(); channel == nil && len(channels) > 0 {
+		channel = channels[0]
+	}
+	if channel == nil {
+		return fmt.Errorf("Not connected to chat, join a channel first")
+	}
+	if err := chat.sendError(channel, "whispers:edit"); err != nil {
+		return err
+	}
+
+	out := newOutgoingText("/w " + user + " " + text)
+	out.Command = true
+	channel.SendChatMsg(out)
+
+	// Twitch does not echo whispers, so our side of the conversation is recorded here
+	ev := channel.newEvent(EventWhisper, nil)
+	ev.Channel = ""
+	ev.User = channel.username()
+	ev.Thread = user
+	ev.Text = text
+	channel.emit(ev)
+	return nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/walle/cfg"
+)
+
+// Settings read from twicciand.toml. Every setting has a default, so the file
+// only needs the ones a user wants to change. Empty strings use twitch's or
+// twicciand's own choice.
+type Config struct {
+	Listen    ListenConfig    `toml:"listen"`
+	Twitch    TwitchConfig    `toml:"twitch"`
+	Chat      ChatConfig      `toml:"chat"`
+	Cache     CacheConfig     `toml:"cache"`
+	Log       LogConfig       `toml:"log"`
+	YoutubeDl YoutubeDlConfig `toml:"youtube_dl"`
+}
+
+// Where clients and twitch's login redirect reach the daemon
+type ListenConfig struct {
+	Rpc      string `toml:"rpc"`       // JSON-RPC over tcp
+	Chat     string `toml:"chat"`      // Chat websocket, served on /ws
+	AuthPort int    `toml:"auth_port"` // Must match the client id's redirect url
+}
+
+// The client id, its accounts and twitch's endpoints
+type TwitchConfig struct {
+	ClientId         string   `toml:"client_id,omitempty"`
+	ClientSecret     string   `toml:"client_secret,omitempty"`
+	AuthFlow         string   `toml:"auth_flow,omitempty"`        // browser or device
+	CredentialStore  string   `toml:"credential_store,omitempty"` // secret-service, file (only obfuscated without TWICCIAND_CREDENTIALS_KEY), config or memory
+	Accounts         []string `toml:"accounts"`
+	ValidateInterval duration `toml:"validate_interval"`
+	ApiUrl           string   `toml:"api_url,omitempty"`
+	AuthorizeUrl     string   `toml:"authorize_url,omitempty"`
+	TokenUrl         string   `toml:"token_url,omitempty"`
+	RevokeUrl        string   `toml:"revoke_url,omitempty"`
+	DeviceUrl        string   `toml:"device_url,omitempty"`
+	ValidateUrl      string   `toml:"validate_url,omitempty"`
+}
+
+// How chat is reached and what is kept of it
+type ChatConfig struct {
+	Transport     string   `toml:"transport,omitempty"` // tls, tcp or websocket
+	Server        string   `toml:"server,omitempty"`
+	TLSCA         string   `toml:"tls_ca,omitempty"`
+	TLSSkipVerify bool     `toml:"tls_skip_verify"`
+	MaxRetries    int      `toml:"max_retries"`
+	HistorySize   int      `toml:"history_size"`
+	Replay        int      `toml:"replay"` // Messages sent to a client joining a channel
+	Log           bool     `toml:"log"`
+	ColorMode     string   `toml:"color_mode,omitempty"` // none, dark or light
+	VerifiedBots  []string `toml:"verified_bots"`        // Accounts which are verified bots
+}
+
+type CacheConfig struct {
+	ApiTTL duration `toml:"api_ttl"` // How long twitch's answers are reused, 0 disables the cache
+}
+
+type LogConfig struct {
+	Level string `toml:"level"`          // info, or debug to also log every RPC call
+	File  string `toml:"file,omitempty"` // Logs go to stderr unless set
+}
+
+type YoutubeDlConfig struct {
+	Path string   `toml:"path"`
+	Args []string `toml:"args"` // Added before the arguments of each call
+}
+
+// A time.Duration written as "30s" or "1h" in the config file
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Every problem found in a config file, reported together
+type ConfigErrors []string
+
+func (errs ConfigErrors) Error() string {
+	return strings.Join(errs, "\n")
+}
+
+// Log levels
+const (
+	LogInfo  = "info"
+	LogDebug = "debug"
+)
+
+func DefaultConfig() *Config {
+	config := new(Config)
+	config.Listen.Rpc = ":1921"
+	config.Listen.Chat = ":1922"
+	config.Listen.AuthPort = defaultAuthPort
+	config.Twitch.Accounts = []string{defaultAccount}
+	config.Twitch.ValidateInterval.Duration = validateInterval
+	config.Chat.MaxRetries = 3
+	config.Chat.HistorySize = 500
+	config.Chat.Replay = 50
+	config.Chat.VerifiedBots = []string{}
+	config.Cache.ApiTTL.Duration = apiCacheTTL
+	config.Log.Level = LogInfo
+	config.YoutubeDl.Path = "youtube-dl"
+	config.YoutubeDl.Args = []string{}
+	return config
+}
+
+// File holding the settings, unless --config names another
+func configFile() string {
+	return path.Join(configDir(), "twicciand.toml")
+}
+
+// Read a config file over the defaults and check it
+func LoadConfig(file string) (*Config, error) {
+	config := DefaultConfig()
+	meta, err := toml.DecodeFile(file, config)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s: %s", file, err)
+	}
+
+	var errs ConfigErrors
+	// A misspelled setting would otherwise be ignored without a word
+	for _, key := range meta.Undecoded() {
+		errs = append(errs, fmt.Sprintf("Unknown setting: %s", key))
+	}
+	if err := config.Validate(); err != nil {
+		errs = append(errs, err.(ConfigErrors)...)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+// Write the settings, such as after moving them out of twicciand.conf
+func (config *Config) Save(file string) error {
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return toml.NewEncoder(out).Encode(config)
+}
+
+// Check every setting, returning ConfigErrors listing what is wrong
+func (config *Config) Validate() error {
+	var errs ConfigErrors
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	for key, address := range map[string]string{"listen.rpc": config.Listen.Rpc, "listen.chat": config.Listen.Chat} {
+		if _, port, err := net.SplitHostPort(address); err != nil {
+			fail("%s: %s", key, err)
+		} else if _, err := strconv.Atoi(port); err != nil {
+			fail("%s: invalid port %s", key, port)
+		}
+	}
+	if config.Listen.AuthPort <= 0 || config.Listen.AuthPort > 65535 {
+		fail("listen.auth_port: invalid port %d", config.Listen.AuthPort)
+	}
+
+	switch config.Twitch.AuthFlow {
+	case "", "browser", "device":
+	default:
+		fail("twitch.auth_flow: must be browser or device, not %s", config.Twitch.AuthFlow)
+	}
+	switch config.Twitch.CredentialStore {
+	case "", StoreSecretService, StoreFile, StoreConfig, StoreMemory:
+	default:
+		fail("twitch.credential_store: unknown store %s", config.Twitch.CredentialStore)
+	}
+	if config.Twitch.ValidateInterval.Duration <= 0 {
+		fail("twitch.validate_interval: must be positive")
+	}
+	for key, endpoint := range map[string]string{
+		"twitch.api_url":       config.Twitch.ApiUrl,
+		"twitch.authorize_url": config.Twitch.AuthorizeUrl,
+		"twitch.token_url":     config.Twitch.TokenUrl,
+		"twitch.revoke_url":    config.Twitch.RevokeUrl,
+		"twitch.device_url":    config.Twitch.DeviceUrl,
+		"twitch.validate_url":  config.Twitch.ValidateUrl,
+	} {
+		if endpoint == "" {
+			continue
+		}
+		if parsed, err := url.Parse(endpoint); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			fail("%s: not an http url: %s", key, endpoint)
+		}
+	}
+
+	if _, err := config.Chat.ChatServer(); err != nil {
+		fail("chat: %s", err)
+	}
+	if config.Chat.MaxRetries < 0 {
+		fail("chat.max_retries: must not be negative")
+	}
+	if config.Chat.HistorySize < 0 {
+		fail("chat.history_size: must not be negative")
+	}
+	if config.Chat.Replay < 0 {
+		fail("chat.replay: must not be negative")
+	}
+	if _, err := ParseColorMode(config.Chat.ColorMode); err != nil {
+		fail("chat.color_mode: %s", err)
+	}
+	accounts := make(map[string]bool)
+	for _, name := range config.Twitch.AccountNames() {
+		accounts[name] = true
+	}
+	for _, name := range config.Chat.VerifiedBots {
+		if !accounts[strings.ToLower(name)] {
+			fail("chat.verified_bots: %s is not one of twitch.accounts", name)
+		}
+	}
+
+	if config.Cache.ApiTTL.Duration < 0 {
+		fail("cache.api_ttl: must not be negative")
+	}
+	if config.Log.Level != LogInfo && config.Log.Level != LogDebug {
+		fail("log.level: must be info or debug, not %s", config.Log.Level)
+	}
+	if config.YoutubeDl.Path == "" {
+		fail("youtube_dl.path: must not be empty")
+	}
+
+	if len(errs) > 0 {
+		// Maps are walked in random order
+		sort.Strings(errs)
+		return errs
+	}
+	return nil
+}
+
+// Names of the accounts, lowercased and without duplicates
+func (config *TwitchConfig) AccountNames() []string {
+	return parseAccountNames(strings.Join(config.Accounts, ","))
+}
+
+// Check if an account is a verified bot, which may send far more messages than regular accounts
+func (config *ChatConfig) IsVerifiedBot(account string) bool {
+	for _, name := range config.VerifiedBots {
+		if strings.ToLower(name) == account {
+			return true
+		}
+	}
+	return false
+}
+
+// The chat server the settings describe
+func (config *ChatConfig) ChatServer() (*ChatServer, error) {
+	return NewChatServer(config.Transport, config.Server, config.TLSCA, config.TLSSkipVerify)
+}
+
+// Settings of twicciand.conf from before twicciand.toml, moved by migrateConfig.
+// The daemon keeps writing usernames, the active account and tokens in the
+// config store to twicciand.conf.
+var oldConfigKeys = []string{
+	"chat_color_mode", "chat_verified_bot", "chat_transport", "chat_server", "chat_tls_ca",
+	"chat_tls_skip_verify", "chat_history_size", "chat_log", "oauth_authorize_url",
+	"oauth_token_url", "oauth_revoke_url", "oauth_device_url", "auth_port", "client_secret",
+	"auth_flow", "credential_store", "accounts",
+}
+
+// Build the settings from the key=value settings of twicciand.conf, removing
+// them from it. Values which cannot be read keep their default.
+func migrateConfig(file *cfg.ConfigFile) *Config {
+	config := DefaultConfig()
+	old := make(map[string]string)
+	for _, key := range oldConfigKeys {
+		if value, err := file.Config.GetString(key); err == nil && value != "" {
+			old[key] = value
+		}
+	}
+	number := func(key string, value *int) {
+		if _, ok := old[key]; !ok {
+			return
+		}
+		if n, err := strconv.Atoi(old[key]); err == nil {
+			*value = n
+		} else {
+			log.Print("Invalid ", key, ": ", old[key])
+		}
+	}
+
+	config.Chat.ColorMode = old["chat_color_mode"]
+	config.Chat.Transport = old["chat_transport"]
+	config.Chat.Server = old["chat_server"]
+	config.Chat.TLSCA = old["chat_tls_ca"]
+	config.Chat.TLSSkipVerify = old["chat_tls_skip_verify"] == "true"
+	number("chat_history_size", &config.Chat.HistorySize)
+	config.Chat.Log = old["chat_log"] == "true"
+	config.Twitch.AuthorizeUrl = old["oauth_authorize_url"]
+	config.Twitch.TokenUrl = old["oauth_token_url"]
+	config.Twitch.RevokeUrl = old["oauth_revoke_url"]
+	config.Twitch.DeviceUrl = old["oauth_device_url"]
+	number("auth_port", &config.Listen.AuthPort)
+	config.Twitch.ClientSecret = old["client_secret"]
+	config.Twitch.AuthFlow = old["auth_flow"]
+	config.Twitch.CredentialStore = old["credential_store"]
+	if accounts, ok := old["accounts"]; ok {
+		config.Twitch.Accounts = parseAccountNames(accounts)
+	}
+	// The old setting was for every account
+	if old["chat_verified_bot"] == "true" {
+		config.Chat.VerifiedBots = append([]string{}, config.Twitch.Accounts...)
+	}
+
+	for key := range old {
+		file.Config.SetString(key, "")
+	}
+	return config
+}
+
+// Read the settings from file. The default file is created on first use,
+// from the settings of twicciand.conf when it has any.
+func loadConfigFile(file string, old *cfg.ConfigFile) (*Config, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) && file == configFile() {
+		config := migrateConfig(old)
+		if err := config.Save(file); err != nil {
+			return nil, fmt.Errorf("Could not create %s: %s", file, err)
+		}
+		if err := old.Persist(); err != nil {
+			log.Print("Could not remove the moved settings from twicciand.conf: ", err)
+		}
+		log.Print("Wrote the settings to ", file)
+	}
+	return LoadConfig(file)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Settings which take effect without restarting the daemon
+var liveSettings = map[string]bool{
+	"log.level":                true,
+	"log.file":                 true,
+	"cache.api_ttl":            true,
+	"twitch.validate_interval": true,
+	"chat.color_mode":          true,
+	"chat.replay":              true,
+	"chat.verified_bots":       true,
+}
+
+// What reloading the settings changed
+type ConfigReload struct {
+	Applied     []string `json:"applied"`          // Changed settings now in use
+	NeedRestart []string `json:"need_restart"`     // Changed settings used once the daemon restarts
+	Errors      []string `json:"errors,omitempty"` // Highlight rules or filters which could not be read
+}
+
+// The settings in use, read again from their file on SIGHUP or the
+// config.reload RPC. Settings which need a restart keep their old value
+// here, so they are reported on every reload until the daemon restarts.
+type Settings struct {
+	File   string
+	config *Config
+	chat   *TwitchChat
+	lock   sync.Mutex
+}
+
+func NewSettings(file string, config *Config, chat *TwitchChat) *Settings {
+	settings := new(Settings)
+	settings.File = file
+	settings.config = config
+	settings.chat = chat
+	return settings
+}
+
+// The settings in use, which must not be changed
+func (settings *Settings) Config() *Config {
+	settings.lock.Lock()
+	defer settings.lock.Unlock()
+	return settings.config
+}
+
+// Read the settings, highlight rules and filters again and apply what can be
+// applied. A file with invalid settings leaves every setting as it was.
+func (settings *Settings) Reload() (*ConfigReload, error) {
+	config, err := LoadConfig(settings.File)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.lock.Lock()
+	defer settings.lock.Unlock()
+	reload := &ConfigReload{Applied: []string{}, NeedRestart: []string{}}
+	for _, key := range diffConfig(settings.config, config) {
+		if liveSettings[key] {
+			reload.Applied = append(reload.Applied, key)
+		} else {
+			reload.NeedRestart = append(reload.NeedRestart, key)
+		}
+	}
+	settings.apply(config)
+
+	if err := settings.chat.highlights.Load(highlightsFile()); err != nil {
+		reload.Errors = append(reload.Errors, "Could not load highlight rules: "+err.Error())
+	}
+	if err := settings.chat.filters.Load(filtersFile()); err != nil {
+		reload.Errors = append(reload.Errors, "Could not load chat filters: "+err.Error())
+	}
+	return reload, nil
+}
+
+// Put the live settings of config in use. The settings lock must be held.
+func (settings *Settings) apply(config *Config) {
+	// The log file is opened again even when unchanged, for log rotation
+	if err := setupLogging(config.Log); err != nil {
+		log.Print("Could not open the log file: ", err)
+	}
+	if config.Chat.ColorMode != settings.config.Chat.ColorMode {
+		mode, _ := ParseColorMode(config.Chat.ColorMode)
+		settings.chat.colors.SetMode(mode)
+	}
+	settings.chat.SetReplay(config.Chat.Replay)
+	for _, name := range settings.chat.accounts.Names() {
+		account := settings.chat.accounts.Get(name)
+		account.Api.cache.SetTTL(config.Cache.ApiTTL.Duration)
+		account.Auth.SetValidateInterval(config.Twitch.ValidateInterval.Duration)
+		account.Limits.SetVerified(config.Chat.IsVerifiedBot(name))
+	}
+
+	// Settings are shared with readers of Config, so the running ones are copied
+	running := *settings.config
+	running.Log = config.Log
+	running.Cache = config.Cache
+	running.Twitch.ValidateInterval = config.Twitch.ValidateInterval
+	running.Chat.ColorMode = config.Chat.ColorMode
+	running.Chat.Replay = config.Chat.Replay
+	running.Chat.VerifiedBots = config.Chat.VerifiedBots
+	settings.config = &running
+}
+
+// Reload the settings whenever the daemon receives SIGHUP
+func (settings *Settings) ReloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		reload, err := settings.Reload()
+		if err != nil {
+			log.Print("Keeping the current settings, ", settings.File, " is invalid:\n", err)
+			continue
+		}
+		logConfigReload(reload)
+	}
+}
+
+// Tell which settings were reloaded
+func logConfigReload(reload *ConfigReload) {
+	log.Print("Reloaded the settings")
+	if len(reload.Applied) > 0 {
+		log.Print("Now using ", strings.Join(reload.Applied, ", "))
+	}
+	if len(reload.NeedRestart) > 0 {
+		log.Print("Restart the daemon to use ", strings.Join(reload.NeedRestart, ", "))
+	}
+	for _, err := range reload.Errors {
+		log.Print(err)
+	}
+}
+
+// Names of the settings which differ, such as chat.color_mode
+func diffConfig(old *Config, next *Config) []string {
+	changed := []string{}
+	oldSections := reflect.ValueOf(old).Elem()
+	nextSections := reflect.ValueOf(next).Elem()
+	for i := 0; i < oldSections.NumField(); i++ {
+		section := oldSections.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			if reflect.DeepEqual(section.Field(j).Interface(), nextSections.Field(i).Field(j).Interface()) {
+				continue
+			}
+			key := tomlKey(oldSections.Type().Field(i)) + "." + tomlKey(section.Type().Field(j))
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// Name of a field in the config file
+func tomlKey(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("toml"), ",")[0]
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigReload(t *testing.T) {
+	Convey("Test reloading the settings", t, func() {
+		dir, err := ioutil.TempDir("", "twicciand")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		defer os.Setenv("HOME", os.Getenv("HOME"))
+		os.Setenv("HOME", dir)
+		os.MkdirAll(configDir(), 0755)
+		file := path.Join(dir, "twicciand.toml")
+		ioutil.WriteFile(file, nil, 0600)
+
+		account := NewAccount(defaultAccount)
+		chat := &TwitchChat{colors: NewColorCache(16), accounts: NewAccounts(), highlights: NewHighlighter(), filters: NewChatFilters()}
+		chat.accounts.Add(account)
+		chat.filters.Ignore("someone")
+		settings := NewSettings(file, DefaultConfig(), chat)
+
+		Convey("Live settings are applied, the others wait for a restart", func() {
+			ioutil.WriteFile(file, []byte("[listen]\nrpc = \":2921\"\n\n[cache]\napi_ttl = \"1m\"\n\n[twitch]\nvalidate_interval = \"5m\"\n"), 0600)
+			reload, err := settings.Reload()
+			So(err, ShouldBeNil)
+			So(reload.Applied, ShouldResemble, []string{"twitch.validate_interval", "cache.api_ttl"})
+			So(reload.NeedRestart, ShouldResemble, []string{"listen.rpc"})
+			So(account.Api.cache.ttl, ShouldEqual, time.Minute)
+			So(account.Auth.ValidateInterval, ShouldEqual, 5*time.Minute)
+			So(settings.Config().Listen.Rpc, ShouldEqual, ":1921")
+
+			// Until the daemon restarts
+			reload, err = settings.Reload()
+			So(err, ShouldBeNil)
+			So(reload.Applied, ShouldBeEmpty)
+			So(reload.NeedRestart, ShouldResemble, []string{"listen.rpc"})
+		})
+		Convey("Replayed events and verified bots change right away", func() {
+			ioutil.WriteFile(file, []byte("[chat]\nreplay = 5\nverified_bots = [\"default\"]\n"), 0600)
+			reload, err := settings.Reload()
+			So(err, ShouldBeNil)
+			So(reload.Applied, ShouldResemble, []string{"chat.replay", "chat.verified_bots"})
+			So(reload.NeedRestart, ShouldBeEmpty)
+			So(chat.replayCount(), ShouldEqual, 5)
+			So(account.Limits.Verified(), ShouldBeTrue)
+		})
+		Convey("Invalid settings leave the current ones in place", func() {
+			ioutil.WriteFile(file, []byte("[cache]\napi_ttl = \"-1s\"\n"), 0600)
+			_, err := settings.Reload()
+			So(err, ShouldNotBeNil)
+			So(settings.Config().Cache.ApiTTL.Duration, ShouldEqual, apiCacheTTL)
+		})
+		Convey("Filters are read again from their file", func() {
+			ioutil.WriteFile(filtersFile(), []byte(`{"ignored":["another"],"filters":[]}`), 0600)
+			_, err := settings.Reload()
+			So(err, ShouldBeNil)
+			_, shown := chat.filters.Apply("someone", "", "hello")
+			So(shown, ShouldBeTrue)
+			_, shown = chat.filters.Apply("another", "", "hello")
+			So(shown, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/walle/cfg"
+)
+
+func TestConfig(t *testing.T) {
+	Convey("Test reading the settings", t, func() {
+		dir, err := ioutil.TempDir("", "twicciand")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		file := path.Join(dir, "twicciand.toml")
+
+		Convey("The defaults are valid", func() {
+			So(DefaultConfig().Validate(), ShouldBeNil)
+		})
+		Convey("Settings left out keep their default", func() {
+			ioutil.WriteFile(file, []byte("[listen]\nrpc = \"127.0.0.1:2921\"\n\n[cache]\napi_ttl = \"2m\"\n"), 0600)
+			config, err := LoadConfig(file)
+			So(err, ShouldBeNil)
+			So(config.Listen.Rpc, ShouldEqual, "127.0.0.1:2921")
+			So(config.Listen.Chat, ShouldEqual, ":1922")
+			So(config.Cache.ApiTTL.Duration, ShouldEqual, 2*time.Minute)
+			So(config.Chat.MaxRetries, ShouldEqual, 3)
+		})
+		Convey("Every problem is reported at once", func() {
+			ioutil.WriteFile(file, []byte("[listen]\nauth_port = 0\n\n[chat]\ntransport = \"carrier-pigeon\"\nmax_retry = 5\n"), 0600)
+			_, err := LoadConfig(file)
+			So(err, ShouldNotBeNil)
+			errs := err.(ConfigErrors)
+			So(errs, ShouldHaveLength, 3)
+			So(err.Error(), ShouldContainSubstring, "listen.auth_port")
+			So(err.Error(), ShouldContainSubstring, "Unknown chat transport")
+			So(err.Error(), ShouldContainSubstring, "Unknown setting: chat.max_retry")
+		})
+		Convey("The settings of twicciand.conf are moved to the new file", func() {
+			old, _ := cfg.NewConfigFile(path.Join(dir, "twicciand.conf"))
+			old.Config.SetString("chat_transport", "websocket")
+			old.Config.SetString("chat_history_size", "100")
+			old.Config.SetString("auth_port", "8080")
+			old.Config.SetString("accounts", "Main,bot")
+			old.Config.SetString("username", "someone")
+
+			config := migrateConfig(old)
+			So(config.Save(file), ShouldBeNil)
+			config, err := LoadConfig(file)
+			So(err, ShouldBeNil)
+			So(config.Chat.Transport, ShouldEqual, TransportWebsocket)
+			So(config.Chat.HistorySize, ShouldEqual, 100)
+			So(config.Listen.AuthPort, ShouldEqual, 8080)
+			So(config.Twitch.AccountNames(), ShouldResemble, []string{"main", "bot"})
+
+			// What the daemon writes itself stays behind
+			transport, _ := old.Config.GetString("chat_transport")
+			So(transport, ShouldEqual, "")
+			username, _ := old.Config.GetString("username")
+			So(username, ShouldEqual, "someone")
+		})
+	})
+}
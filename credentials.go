@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/walle/cfg"
+)
+
+// Names of the credential stores, as chosen with credential_store in the config
+const (
+	StoreSecretService = "secret-service"
+	StoreFile          = "file"
+	StoreConfig        = "config"
+	StoreMemory        = "memory"
+)
+
+// What is kept secret about the login
+type Credentials struct {
+	Username     string    `json:"username"`
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at,omitempty"`
+}
+
+// Somewhere to keep the credentials between runs
+type CredentialStore interface {
+	Name() string
+	// Load returns nil credentials when none were saved
+	Load() (*Credentials, error)
+	Save(creds *Credentials) error
+	Clear() error
+}
+
+// Pick a credential store by name for an account. An empty name uses the
+// Secret Service when it is available, then the credentials file, and the
+// config file as last resort. The default account keeps the locations used
+// before there were several accounts.
+func NewCredentialStore(name string, file *cfg.ConfigFile, account string) (CredentialStore, error) {
+	credentialsFile := path.Join(configDir(), "credentials")
+	configPrefix := ""
+	if account != defaultAccount {
+		credentialsFile += "-" + account
+		configPrefix = account + "."
+	}
+
+	switch name {
+	case StoreSecretService:
+		if !secretServiceAvailable() {
+			return nil, fmt.Errorf("The Secret Service is not available, is secret-tool installed?")
+		}
+		return &secretServiceStore{account: account}, nil
+	case StoreFile:
+		return newEncryptedFileStore(credentialsFile)
+	case StoreConfig:
+		return &configStore{file: file, prefix: configPrefix}, nil
+	case StoreMemory:
+		return new(memoryStore), nil
+	case "":
+		if secretServiceAvailable() {
+			return &secretServiceStore{account: account}, nil
+		}
+		store, err := newEncryptedFileStore(credentialsFile)
+		if err == nil {
+			return store, nil
+		}
+		log.Print("Could not use the credentials file, the token is kept in the config file: ", err)
+		return &configStore{file: file, prefix: configPrefix}, nil
+	}
+	return nil, fmt.Errorf("Unknown credential store: %s", name)
+}
+
+// The credentials of an auth object
+func authCredentials(auth *TwitchAuth) *Credentials {
+	auth.lock.RLock()
+	defer auth.lock.RUnlock()
+	return &Credentials{
+		Username:     auth.Username,
+		Token:        auth.Password,
+		RefreshToken: auth.RefreshToken,
+		ExpiresAt:    auth.ExpiresAt,
+	}
+}
+
+// Put saved credentials back into an auth object at startup. Watchers are
+// not told, nothing used the auth object before.
+func (auth *TwitchAuth) restoreCredentials(creds *Credentials) {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	if creds.Username != "" {
+		auth.Username = creds.Username
+	}
+	auth.Password = creds.Token
+	auth.RefreshToken = creds.RefreshToken
+	auth.ExpiresAt = creds.ExpiresAt
+}
+
+// Move a token left in the config file by older versions into the store
+func migrateCredentials(file *cfg.ConfigFile, store CredentialStore) {
+	if store.Name() == StoreConfig {
+		return
+	}
+	old, err := (&configStore{file: file}).Load()
+	if err != nil || old == nil {
+		return
+	}
+	if err = store.Save(old); err != nil {
+		log.Print("Could not move the auth token out of the config file: ", err)
+		return
+	}
+	for _, key := range []string{"token", "refresh_token", "token_expires"} {
+		file.Config.SetString(key, "")
+	}
+	if err = file.Persist(); err != nil {
+		log.Print("Could not remove the auth token from the config file: ", err)
+		return
+	}
+	log.Print("Moved the auth token from the config file to the ", store.Name(), " credential store")
+}
+
+// Credentials held by the freedesktop Secret Service (gnome-keyring, kwallet),
+// through libsecret's secret-tool
+type secretServiceStore struct {
+	account string
+}
+
+// Attributes identifying the account's secret in the keyring
+func (store *secretServiceStore) attributes() []string {
+	attributes := []string{"service", "twicciand", "type", "credentials"}
+	if store.account != defaultAccount {
+		attributes = append(attributes, "account", store.account)
+	}
+	return attributes
+}
+
+func secretServiceAvailable() bool {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return false
+	}
+	_, err := exec.LookPath("secret-tool")
+	return err == nil
+}
+
+func (store *secretServiceStore) Name() string {
+	return StoreSecretService
+}
+
+func (store *secretServiceStore) Load() (*Credentials, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", append([]string{"lookup"}, store.attributes()...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// secret-tool fails silently when there is no such secret
+		if stderr.Len() == 0 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("secret-tool: %s", strings.TrimSpace(stderr.String()))
+	}
+	creds := new(Credentials)
+	if err := json.Unmarshal(stdout.Bytes(), creds); err != nil {
+		return nil, fmt.Errorf("Could not parse the credentials in the keyring: %s", err)
+	}
+	return creds, nil
+}
+
+func (store *secretServiceStore) Save(creds *Credentials) error {
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", append([]string{"store", "--label=Twicciand " + store.account}, store.attributes()...)...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("secret-tool: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (store *secretServiceStore) Clear() error {
+	exec.Command("secret-tool", append([]string{"clear"}, store.attributes()...)...).Run()
+	return nil
+}
+
+// Credentials in a file encrypted with AES-GCM. The key comes from
+// TWICCIAND_CREDENTIALS_KEY when set. Otherwise it is derived from the
+// machine id and uid, which anyone able to read the file on this machine can
+// rebuild: that only obfuscates the token, keeping it out of plain sight in
+// copies such as backups, and protects nothing from local users or programs.
+type encryptedFileStore struct {
+	file string
+	key  []byte
+}
+
+func newEncryptedFileStore(file string) (*encryptedFileStore, error) {
+	secret := os.Getenv("TWICCIAND_CREDENTIALS_KEY")
+	if secret == "" {
+		machineId, err := ioutil.ReadFile("/etc/machine-id")
+		if err != nil {
+			return nil, fmt.Errorf("No TWICCIAND_CREDENTIALS_KEY and no machine id to derive a key from: %s", err)
+		}
+		secret = strings.TrimSpace(string(machineId)) + ":" + strconv.Itoa(os.Getuid())
+	}
+	key := sha256.Sum256([]byte("twicciand credentials:" + secret))
+	return &encryptedFileStore{file: file, key: key[:]}, nil
+}
+
+func (store *encryptedFileStore) Name() string {
+	return StoreFile
+}
+
+func (store *encryptedFileStore) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(store.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (store *encryptedFileStore) Load() (*Credentials, error) {
+	data, err := ioutil.ReadFile(store.file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	gcm, err := store.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("The credentials file is damaged")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt the credentials file, was it written on another machine?")
+	}
+	creds := new(Credentials)
+	if err = json.Unmarshal(plain, creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (store *encryptedFileStore) Save(creds *Credentials) error {
+	plain, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	gcm, err := store.gcm()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(store.file, gcm.Seal(nonce, nonce, plain, nil), 0600)
+}
+
+func (store *encryptedFileStore) Clear() error {
+	if err := os.Remove(store.file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Credentials in plain text in twicciand.conf, as older versions kept them.
+// Accounts other than the default one prefix the keys with their name.
+type configStore struct {
+	file   *cfg.ConfigFile
+	prefix string
+}
+
+func (store *configStore) Name() string {
+	return StoreConfig
+}
+
+func (store *configStore) Load() (*Credentials, error) {
+	token, err := store.file.Config.GetString(store.prefix + "token")
+	if err != nil || token == "" {
+		return nil, nil
+	}
+	creds := &Credentials{Token: token}
+	creds.Username, _ = store.file.Config.GetString(store.prefix + "username")
+	creds.RefreshToken, _ = store.file.Config.GetString(store.prefix + "refresh_token")
+	if expires, err := store.file.Config.GetString(store.prefix + "token_expires"); err == nil && expires != "" {
+		creds.ExpiresAt, _ = time.Parse(time.RFC3339, expires)
+	}
+	return creds, nil
+}
+
+func (store *configStore) Save(creds *Credentials) error {
+	store.file.Config.SetString(store.prefix+"token", creds.Token)
+	store.file.Config.SetString(store.prefix+"refresh_token", creds.RefreshToken)
+	expires := ""
+	if !creds.ExpiresAt.IsZero() {
+		expires = creds.ExpiresAt.Format(time.RFC3339)
+	}
+	store.file.Config.SetString(store.prefix+"token_expires", expires)
+	store.file.Config.SetString(store.prefix+"username", creds.Username)
+	return store.file.Persist()
+}
+
+func (store *configStore) Clear() error {
+	return store.Save(new(Credentials))
+}
+
+// Credentials kept only while the daemon runs, for tests
+type memoryStore struct {
+	creds *Credentials
+	lock  sync.Mutex
+}
+
+func (store *memoryStore) Name() string {
+	return StoreMemory
+}
+
+func (store *memoryStore) Load() (*Credentials, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.creds == nil {
+		return nil, nil
+	}
+	creds := *store.creds
+	return &creds, nil
+}
+
+func (store *memoryStore) Save(creds *Credentials) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	saved := *creds
+	store.creds = &saved
+	return nil
+}
+
+func (store *memoryStore) Clear() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.creds = nil
+	return nil
+}
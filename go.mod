@@ -0,0 +1,14 @@
+module twicciand
+
+go 1.18
+
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/gorilla/websocket v1.5.0
+	github.com/smartystreets/goconvey v1.6.4
+)
+
+require (
+	github.com/jtolds/gls v4.20.0+incompatible // indirect
+	github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d // indirect
+)
@@ -3,16 +3,20 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	//"fmt"
+	"fmt"
 	"log"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type LocalApi struct {
-	YDLPath string
-	auth    *TwitchAuth
-	chat    *TwitchChat
+	YDLPath  string
+	YDLArgs  []string // Passed to youtube-dl before the arguments of each call
+	auth     *TwitchAuth
+	chat     *TwitchChat
+	settings *Settings
 }
 
 type ParamsUrlConv struct {
@@ -23,6 +27,23 @@ type ParamsLocal struct {
 	Query string `json:"query"`
 }
 
+type ParamsAccount struct {
+	Account string `json:"account"`
+}
+
+type ParamsSend struct {
+	Account string `json:"account"`
+	Channel string `json:"channel"`
+	Id      string `json:"id"`
+	Text    string `json:"text"`
+}
+
+type ParamsHistory struct {
+	Channel string    `json:"channel"`
+	Before  time.Time `json:"before"`
+	Limit   int       `json:"limit"`
+}
+
 // Create a constructor so a new API object cannot be created without an auth key
 func NewLocalApi(ydlPath string, auth *TwitchAuth, chat *TwitchChat) *LocalApi {
 	api := new(LocalApi)
@@ -44,8 +65,8 @@ func (api *LocalApi) getStreamUrl(apiParams []byte) bytes.Buffer {
 
 	// Capture youtube-dl output
 	var output []byte
-	args := []string{"-g", params.Url}
-	if output, err = exec.Command("youtube-dl", args...).Output(); err != nil {
+	args := append(append([]string{}, api.YDLArgs...), "-g", params.Url)
+	if output, err = exec.Command(api.YDLPath, args...).Output(); err != nil {
 		log.Printf("There was a problem running youtube-dl: %s", err)
 	}
 
@@ -67,8 +88,8 @@ func (api *LocalApi) getStreamDesc(apiParams []byte) bytes.Buffer {
 
 	// Capture youtube-dl output
 	var output []byte
-	args := []string{"--get-description", params.Url}
-	if output, err = exec.Command("youtube-dl", args...).Output(); err != nil {
+	args := append(append([]string{}, api.YDLArgs...), "--get-description", params.Url)
+	if output, err = exec.Command(api.YDLPath, args...).Output(); err != nil {
 		log.Printf("There was a problem running youtube-dl: %s", err)
 	}
 
@@ -79,14 +100,374 @@ func (api *LocalApi) getStreamDesc(apiParams []byte) bytes.Buffer {
 	return result
 }
 
-// Gets the actual stream URL using youtube-dl
+// Reports whether we are logged in, along with the token's user and scopes
 func (api *LocalApi) isAuthenticated(apiParams []byte) bytes.Buffer {
+	return api.getAuthStatus(apiParams)
+}
+
+// The auth of the account a call names, the active account when it names none
+func (api *LocalApi) accountAuth(apiParams []byte) (*TwitchAuth, error) {
+	params := new(ParamsAccount)
+	json.Unmarshal(apiParams, params)
+	if api.chat == nil || api.chat.accounts == nil {
+		return api.auth, nil
+	}
+	account := api.chat.accounts.Get(params.Account)
+	if account == nil {
+		return nil, fmt.Errorf("Unknown account: %s", params.Account)
+	}
+	return account.Auth, nil
+}
+
+// Returns how many chat messages are waiting behind twitch's rate limit
+func (api *LocalApi) getChatQueue(apiParams []byte) bytes.Buffer {
+	depth := 0
+	for _, channel := range api.chat.Channels() {
+		depth += channel.QueueDepth()
+	}
+
+	var result bytes.Buffer
+	result.WriteString(strconv.Itoa(depth))
+	return result
+}
+
+// Returns stored chat events of a channel sent before a given time
+func (api *LocalApi) getChatHistory(apiParams []byte) bytes.Buffer {
+	params := new(ParamsHistory)
+	err := json.Unmarshal(apiParams, params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.history: %s", err)
+	}
+
+	var result bytes.Buffer
+	if err := validHistoryKey(channelName(params.Channel)); err != nil {
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	events := api.chat.history.Before(channelName(params.Channel), params.Before, params.Limit)
+	if events == nil {
+		events = []*ChatEvent{}
+	}
+
+	json.NewEncoder(&result).Encode(events)
+	return result
+}
+
+// Reports whether we are logged in, and the login url while waiting for one
+func (api *LocalApi) getAuthStatus(apiParams []byte) bytes.Buffer {
+	var result bytes.Buffer
+	auth, err := api.accountAuth(apiParams)
+	if err != nil {
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	json.NewEncoder(&result).Encode(auth.Status())
+	return result
+}
+
+// Starts a login unless one is waiting, returning the status with the url to visit
+func (api *LocalApi) login(apiParams []byte) bytes.Buffer {
+	var result bytes.Buffer
+	auth, err := api.accountAuth(apiParams)
+	if err == nil {
+		err = auth.StartLogin()
+	}
+	if err != nil {
+		log.Printf("Could not start a login: %s", err)
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	json.NewEncoder(&result).Encode(auth.Status())
+	return result
+}
+
+// Starts a login with a code entered on another device, for machines without a browser
+func (api *LocalApi) deviceLogin(apiParams []byte) bytes.Buffer {
+	var result bytes.Buffer
+	auth, err := api.accountAuth(apiParams)
+	if err != nil {
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	login, err := auth.DeviceLogin()
+	if err != nil {
+		log.Printf("Could not start a device login: %s", err)
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	json.NewEncoder(&result).Encode(login)
+	return result
+}
+
+// Forgets the tokens and starts waiting for a new login
+func (api *LocalApi) logout(apiParams []byte) bytes.Buffer {
+	var result bytes.Buffer
+	auth, err := api.accountAuth(apiParams)
+	if err != nil {
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	auth.Logout()
+	result.WriteString("true")
+	return result
+}
+
+// Lists the configured accounts and which one is active
+func (api *LocalApi) listAccounts(apiParams []byte) bytes.Buffer {
+	var result bytes.Buffer
+	json.NewEncoder(&result).Encode(api.chat.accounts.List())
+	return result
+}
+
+// Makes another account the one chat and twitch calls use
+func (api *LocalApi) switchAccount(apiParams []byte) bytes.Buffer {
+	params := new(ParamsAccount)
+	err := json.Unmarshal(apiParams, params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call accounts.switch: %s", err)
+	}
+
+	var result bytes.Buffer
+	if err = api.chat.accounts.Switch(params.Account); err != nil {
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	result.WriteString("true")
+	return result
+}
+
+// Sends a chat message as the given account, to the current channel unless one is given
+func (api *LocalApi) sendAs(apiParams []byte) bytes.Buffer {
+	params := new(ParamsSend)
+	err := json.Unmarshal(apiParams, params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.send: %s", err)
+	}
+
+	var result bytes.Buffer
+	account := api.chat.accounts.Get(params.Account)
+	if account == nil {
+		json.NewEncoder(&result).Encode(fmt.Sprintf("Unknown account: %s", params.Account))
+		return result
+	}
+	out := newOutgoingText(params.Text)
+	if params.Id != "" {
+		out.Id = params.Id
+	}
+	if err = api.chat.SendAs(account, params.Channel, out); err != nil {
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	result.WriteString("true")
+	return result
+}
+
+// Returns the health of every chat channel's connection
+func (api *LocalApi) getChatStatus(apiParams []byte) bytes.Buffer {
+	var result bytes.Buffer
+	json.NewEncoder(&result).Encode(api.chat.Status())
+	return result
+}
+
+// Sends a whisper to a user
+func (api *LocalApi) sendWhisper(apiParams []byte) bytes.Buffer {
+	var params struct {
+		User string `json:"user"`
+		Text string `json:"text"`
+	}
+	err := json.Unmarshal(apiParams, &params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.whisper: %s", err)
+	}
+
 	var result bytes.Buffer
-	if api.auth.Password == "" {
-		result.WriteString("false")
-	} else {
-		result.WriteString("true")
+	if err == nil {
+		err = api.chat.Whisper(params.User, params.Text)
+	}
+	if err != nil {
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	result.WriteString("true")
+	return result
+}
+
+// Gets the stored whispers exchanged with a user, the channel parameter holds the user
+func (api *LocalApi) getWhispers(apiParams []byte) bytes.Buffer {
+	params := new(ParamsHistory)
+	err := json.Unmarshal(apiParams, params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.whispers: %s", err)
+	}
+
+	var result bytes.Buffer
+	if err := validHistoryKey(whisperThread(params.Channel)); err != nil {
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	events := api.chat.history.Before(whisperThread(params.Channel), params.Before, params.Limit)
+	if events == nil {
+		events = []*ChatEvent{}
+	}
+
+	json.NewEncoder(&result).Encode(events)
+	return result
+}
+
+// Searches stored chat, see ChatSearch for the accepted filters
+func (api *LocalApi) searchChat(apiParams []byte) bytes.Buffer {
+	params := new(ChatSearch)
+	err := json.Unmarshal(apiParams, params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.search: %s", err)
+	}
+
+	var result bytes.Buffer
+	json.NewEncoder(&result).Encode(api.chat.history.Search(params))
+	return result
+}
+
+// Exports a channel's stored chat as an irc log, json lines or html. The
+// export is itself a string, so failures are reported as {"error": "..."}.
+func (api *LocalApi) exportChat(apiParams []byte) bytes.Buffer {
+	var result bytes.Buffer
+	var failure struct {
+		Error string `json:"error"`
+	}
+	params := new(ChatExport)
+	err := json.Unmarshal(apiParams, params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.export: %s", err)
+		failure.Error = fmt.Sprintf("Incorrect parameters: %s", err)
+		json.NewEncoder(&result).Encode(failure)
+		return result
+	}
+
+	var export bytes.Buffer
+	if err = api.chat.history.Export(params, &export); err != nil {
+		log.Printf("Could not export chat: %s", err)
+		failure.Error = err.Error()
+		json.NewEncoder(&result).Encode(failure)
+		return result
+	}
+
+	json.NewEncoder(&result).Encode(export.String())
+	return result
+}
+
+// Returns the chat highlight rules
+func (api *LocalApi) getHighlights(apiParams []byte) bytes.Buffer {
+	var result bytes.Buffer
+	json.NewEncoder(&result).Encode(api.chat.highlights.Rules())
+	return result
+}
+
+// Replaces the chat highlight rules and saves them
+func (api *LocalApi) setHighlights(apiParams []byte) bytes.Buffer {
+	var params struct {
+		Rules []HighlightRule `json:"rules"`
+	}
+	err := json.Unmarshal(apiParams, &params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.highlights.set: %s", err)
+	}
+
+	var result bytes.Buffer
+	if err == nil {
+		err = api.chat.highlights.SetRules(params.Rules)
+	}
+	if err == nil {
+		err = api.chat.highlights.Save(highlightsFile())
+	}
+	if err != nil {
+		log.Printf("Could not set highlight rules: %s", err)
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	result.WriteString("true")
+	return result
+}
+
+// Returns the ignored users and chat filters
+func (api *LocalApi) getFilters(apiParams []byte) bytes.Buffer {
+	var result bytes.Buffer
+	json.NewEncoder(&result).Encode(api.chat.filters.rules())
+	return result
+}
+
+// Ignores a user, given by login or user id
+func (api *LocalApi) ignoreUser(apiParams []byte) bytes.Buffer {
+	var params struct {
+		User string `json:"user"`
+	}
+	err := json.Unmarshal(apiParams, &params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.ignore.add: %s", err)
+	}
+	if err == nil {
+		err = api.chat.filters.Ignore(params.User)
+	}
+	return api.saveFilters(err)
+}
+
+// Stops ignoring a user
+func (api *LocalApi) unignoreUser(apiParams []byte) bytes.Buffer {
+	var params struct {
+		User string `json:"user"`
+	}
+	err := json.Unmarshal(apiParams, &params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.ignore.remove: %s", err)
+	}
+	if err == nil {
+		api.chat.filters.Unignore(params.User)
+	}
+	return api.saveFilters(err)
+}
+
+// Replaces the chat filters
+func (api *LocalApi) setFilters(apiParams []byte) bytes.Buffer {
+	var params struct {
+		Filters         []ChatFilter `json:"filters"`
+		HideBotCommands bool         `json:"hide_bot_commands"`
+	}
+	err := json.Unmarshal(apiParams, &params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.filters.set: %s", err)
+	}
+	if err == nil {
+		err = api.chat.filters.SetFilters(params.Filters, params.HideBotCommands)
+	}
+	return api.saveFilters(err)
+}
+
+// Saves the filters after a change, or reports why the change failed
+func (api *LocalApi) saveFilters(err error) bytes.Buffer {
+	var result bytes.Buffer
+	if err == nil {
+		err = api.chat.filters.Save(filtersFile())
+	}
+	if err != nil {
+		log.Printf("Could not change chat filters: %s", err)
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
+	}
+	result.WriteString("true")
+	return result
+}
+
+// Reads the settings again, reporting which changed settings are in use and
+// which need a restart
+func (api *LocalApi) reloadConfig(apiParams []byte) bytes.Buffer {
+	var result bytes.Buffer
+	reload, err := api.settings.Reload()
+	if err != nil {
+		log.Printf("Could not reload the settings: %s", err)
+		json.NewEncoder(&result).Encode(err.Error())
+		return result
 	}
+	logConfigReload(reload)
+	json.NewEncoder(&result).Encode(reload)
 	return result
 }
 
@@ -98,7 +479,8 @@ func (api *LocalApi) changeChat(apiParams []byte) bytes.Buffer {
 		log.Printf("There was a problem parsing the requested chat channel")
 	}
 
-	api.chat.AddChannel(api.auth.Username, "#"+params.Query, api.auth.Password)
+	auth := api.chat.Auth()
+	api.chat.AddChannel(auth.User(), "#"+params.Query, auth.Token())
 
 	var result bytes.Buffer
 	result.WriteString("true")
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// Whether logDebug writes anything, set from log.level
+var debugLogging int32
+
+// The file the log is written to, nil for stderr
+var logFile *os.File
+
+// Log what is only of interest when tracking down a problem
+func logDebug(v ...interface{}) {
+	if atomic.LoadInt32(&debugLogging) == 1 {
+		log.Print(v...)
+	}
+}
+
+// Send the log where the settings ask, at their level. The file is appended
+// to, and replaces whichever one was used before.
+func setupLogging(config LogConfig) error {
+	debug := int32(0)
+	if config.Level == LogDebug {
+		debug = 1
+	}
+	atomic.StoreInt32(&debugLogging, debug)
+
+	var file *os.File
+	if config.File != "" {
+		var err error
+		if file, err = os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+		log.SetOutput(file)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+	return nil
+}
@@ -17,6 +17,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -25,11 +26,19 @@ import (
 	"path"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/walle/cfg"
 )
 
 func main() {
+	// Subcommands work on their own, next to a running daemon
+	if len(os.Args) > 1 && os.Args[1] == "export-chat" {
+		os.Exit(runExportChat(os.Args[2:]))
+	}
+	configPath := flag.String("config", configFile(), "file holding the settings")
+	flag.Parse()
+
 	pid := os.Getpid()
 	commandstr := "pgrep twicciand | grep -v " + strconv.Itoa(pid)
 	out, _ := exec.Command("sh", "-c", commandstr).Output()
@@ -38,28 +47,21 @@ func main() {
 		return
 	}
 
-	// Make a new authentication object
-	auth := new(TwitchAuth)
 	// Create a chat object
 	chat := new(TwitchChat)
-	chat.auth = auth
-	chat.colorMap = make(map[string]string)
-	// Create new api objects
-	twitchApi := NewTwitchApi(auth)
-
-	// Run the socket reader
-	reader := NewSocketReader(twitchApi, chat)
-	fmt.Println("Starting SocketReader...")
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go reader.StartReader()
+	chat.colors = NewColorCache(1024)
+	chat.limits = NewChatLimits()
+	chat.commands = NewChatCommands()
+	chat.hub = NewChatHub()
+	chat.whispers = NewWhispers()
+	chat.accounts = NewAccounts()
 
-	// Try finding the config file in the user's .config
-	conffile := path.Join(os.Getenv("HOME"), ".config/twicciand/twicciand.conf")
+	// The daemon keeps what it learns, such as usernames, in twicciand.conf
+	conffile := path.Join(configDir(), "twicciand.conf")
 
 	// If the config file doesn't exist, create one
-	if _, err := os.Stat(path.Join(os.Getenv("HOME"), ".config/twicciand/")); os.IsNotExist(err) {
-		os.Mkdir(path.Join(os.Getenv("HOME"), ".config/twicciand/"), 0755)
+	if _, err := os.Stat(configDir()); os.IsNotExist(err) {
+		os.Mkdir(configDir(), 0755)
 	}
 	if _, err := os.Stat(conffile); err != nil {
 		os.Create(conffile)
@@ -69,47 +71,262 @@ func main() {
 		log.Print("Error parsing config file")
 	}
 
-	// Read the auth token from the config file, or receive it from twitch
-	token, err := file.Config.GetString("token")
-	if err != nil || token == "" {
-		log.Print("Could not find auth token - waiting for twitch's reply")
-		// Wait until we receive the credentials
-		auth.startAuthServer()
-		// Update the config file
-		file.Config.SetString("token", auth.Password)
-	} else {
-		// We have the password in the config file, inject it into the auth object
-		auth.Password = token
+	// Settings come from twicciand.toml, written from those of twicciand.conf the first time
+	config, err := loadConfigFile(*configPath, file)
+	if err != nil {
+		log.Fatal("Invalid settings in ", *configPath, ":\n", err)
+	}
+	if err := setupLogging(config.Log); err != nil {
+		log.Print("Could not open the log file: ", err)
 	}
 
-	// Knowing the username is not necessary, but if it is provided, store it
-	username, err := file.Config.GetString("username")
-	if err != nil || username == "" {
-		result := twitchApi.getUser([]byte(`{"query":"nil"}`))
-		var resultjson map[string]interface{}
-		json.Unmarshal(result.Bytes(), &resultjson)
-		fmt.Println("Your json is:", resultjson["name"].(string))
-		auth.Username = resultjson["name"].(string)
-		fmt.Println("Gotten username:", resultjson["name"].(string))
-
-		file.Config.SetString("username", resultjson["name"].(string))
-	} else {
-		// We have the username in the config file, inject it into the auth object
-		auth.Username = username
+	// Optionally correct username colors for the frontend's theme
+	colorMode, _ := ParseColorMode(config.Chat.ColorMode)
+	chat.colors.SetMode(colorMode)
+
+	// Chat is reached over tls unless configured otherwise
+	chat.server, _ = config.Chat.ChatServer()
+	chat.maxRetries = config.Chat.MaxRetries
+
+	// Keep recent chat in memory, and on disk if the user asked for a chat log
+	logDir := ""
+	if config.Chat.Log {
+		logDir = path.Join(dataDir(), "logs")
 	}
+	chat.history = NewChatHistory(config.Chat.HistorySize, logDir)
+	chat.replay = config.Chat.Replay
 
-	file.Persist()
-	// Print user's authentication token
-	fmt.Println("Your username is:", auth.Username)
-	fmt.Println("Your token is:", auth.Password)
+	// Highlight rules are kept next to the config file
+	chat.highlights = NewHighlighter()
+	if err := chat.highlights.Load(highlightsFile()); err != nil {
+		log.Print("Could not load highlight rules: ", err)
+	}
+	chat.filters = NewChatFilters()
+	if err := chat.filters.Load(filtersFile()); err != nil {
+		log.Print("Could not load chat filters: ", err)
+	}
+
+	// The client id and endpoints can point at a local server for testing
+	for endpoint, value := range map[*string]string{
+		&twitchClientId:    config.Twitch.ClientId,
+		&twitchApiUrl:      config.Twitch.ApiUrl,
+		&oauthAuthorizeUrl: config.Twitch.AuthorizeUrl,
+		&oauthTokenUrl:     config.Twitch.TokenUrl,
+		&oauthRevokeUrl:    config.Twitch.RevokeUrl,
+		&oauthDeviceUrl:    config.Twitch.DeviceUrl,
+		&oauthValidateUrl:  config.Twitch.ValidateUrl,
+	} {
+		if value != "" {
+			*endpoint = value
+		}
+	}
+	// The port twitch sends the browser back to must match the client id's redirect
+	authServer.Port = config.Listen.AuthPort
+
+	// Every account logs in on its own, chat and the api use the active one
+	for _, name := range config.Twitch.AccountNames() {
+		chat.accounts.Add(setupAccount(config, file, chat, name))
+	}
+	if active, err := file.Config.GetString("active_account"); err == nil && active != "" {
+		if err := chat.accounts.Switch(active); err != nil {
+			log.Print(err)
+		}
+	}
+	chat.auth = chat.accounts.Active().Auth
+	chat.accounts.OnSwitch = func(account *Account) {
+		log.Print("Switching to the ", account.Name, " account")
+		chat.SetAuth(account.Auth)
+		file.Config.SetString("active_account", account.Name)
+		file.Persist()
+	}
+
+	// Settings are read again on SIGHUP and the config.reload RPC
+	settings := NewSettings(*configPath, config, chat)
+	go settings.ReloadOnHangup()
+
+	// Run the socket reader
+	reader := NewSocketReader(settings, chat.accounts.Active(), chat)
+	fmt.Println("Starting SocketReader...")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go reader.StartReader()
+
+	// Twitch is asked about the tokens in the background, chat and the RPCs
+	// work anonymously in the meantime
+	go func() {
+		for _, name := range chat.accounts.Names() {
+			loginAccount(file, chat, chat.accounts.Get(name))
+		}
+	}()
 
 	// chat.AddChannel(auth.Username, "#twitchplayspokemon", auth.Password)
 
 	// Start chat server
 	http.Handle("/ws", wsHandler{chat: chat})
-	if err := http.ListenAndServe(":1922", nil); err != nil {
+	if err := http.ListenAndServe(config.Listen.Chat, nil); err != nil {
 		log.Print("Error starting chat websocket server:", err)
 	}
 
 	wg.Wait()
 }
+
+// Create an account with its own credential store, saving its tokens whenever they change
+func setupAccount(config *Config, file *cfg.ConfigFile, chat *TwitchChat, name string) *Account {
+	account := NewAccount(name)
+	account.Api.cache.SetTTL(config.Cache.ApiTTL.Duration)
+	account.Limits.SetVerified(config.Chat.IsVerifiedBot(name))
+	auth := account.Auth
+	auth.ClientSecret = config.Twitch.ClientSecret
+	auth.DeviceFlow = config.Twitch.AuthFlow == "device"
+	auth.ValidateInterval = config.Twitch.ValidateInterval.Duration
+
+	// Tokens are kept out of the config file when the system allows it
+	store, err := NewCredentialStore(config.Twitch.CredentialStore, file, name)
+	if err != nil {
+		log.Print(err, ", the token is kept in the config file")
+		store, _ = NewCredentialStore(StoreConfig, file, name)
+	}
+	if name == defaultAccount {
+		migrateCredentials(file, store)
+	}
+	account.Store = store
+
+	auth.Watch(func(Auth) {
+		saveAuth(store, auth)
+		// Connections sending as the account log in again with the new token when next used
+		chat.closeSenders(name)
+	})
+	// Chat logs in again when it is using this account
+	auth.Watch(chat.authChanged)
+	auth.OnLogin = func(auth *TwitchAuth) {
+		if err := auth.Validate(); err != nil {
+			log.Print("Could not validate the auth token: ", err)
+		}
+		loadUsername(file, account)
+		saveAuth(store, auth)
+		chat.hub.Broadcast(&ChatEvent{Type: EventAuthCompleted, Time: time.Now(), User: auth.User()})
+	}
+	return account
+}
+
+// Read an account's auth token from its credential store. Without one the
+// active account waits for twitch, the others for a login through auth.device.
+func loginAccount(file *cfg.ConfigFile, chat *TwitchChat, account *Account) {
+	auth := account.Auth
+	active := account == chat.accounts.Active()
+	creds, err := account.Store.Load()
+	if err != nil {
+		log.Print("Could not read the saved auth token of the ", account.Name, " account: ", err)
+	}
+	if creds == nil || creds.Token == "" {
+		if active {
+			log.Print("Could not find auth token - chatting anonymously until twitch replies")
+			go auth.Login()
+		} else {
+			log.Print("The ", account.Name, " account is not logged in yet")
+		}
+	} else {
+		// We have a saved token, inject it into the auth object
+		auth.restoreCredentials(creds)
+		// Don't log into chat with a token twitch rejects, it is refreshed if possible
+		if err := auth.Validate(); err != nil {
+			log.Print("Could not validate the auth token: ", err)
+		}
+		if auth.Invalid && active {
+			log.Print("The saved auth token is no longer valid - chatting anonymously until you log in again")
+			auth.restoreCredentials(new(Credentials))
+			go auth.Login()
+		} else if auth.Invalid {
+			log.Print("The saved auth token of the ", account.Name, " account is no longer valid")
+			auth.restoreCredentials(new(Credentials))
+		} else {
+			loadUsername(file, account)
+			saveAuth(account.Store, auth)
+			// Channels joined anonymously while validating can log in now
+			auth.changed()
+		}
+	}
+	go auth.ValidateLoop()
+}
+
+// Read the username from the config file, or ask twitch for it, and save the config
+func loadUsername(file *cfg.ConfigFile, account *Account) {
+	auth := account.Auth
+	// Accounts other than the default one prefix the key with their name
+	key := "username"
+	if account.Name != defaultAccount {
+		key = account.Name + ".username"
+	}
+
+	// Knowing the username is not necessary, but if it is provided, store it
+	username, err := file.Config.GetString(key)
+	if auth.User() != "" {
+		// Validating the token told us who it belongs to
+		file.Config.SetString(key, auth.User())
+	} else if err != nil || username == "" {
+		name, err := lookupUsername(account.Api)
+		if err != nil {
+			log.Print("Could not find out the username: ", err)
+			return
+		}
+		auth.setCredentials(name, auth.Token())
+		file.Config.SetString(key, name)
+	} else {
+		// We have the username in the config file, inject it into the auth object
+		auth.setCredentials(username, auth.Token())
+	}
+
+	file.Persist()
+	fmt.Println("Your username is:", auth.User())
+}
+
+// Ask twitch who the token belongs to
+func lookupUsername(twitchApi *TwitchApi) (string, error) {
+	result := twitchApi.getUser([]byte(`{"query":"nil"}`))
+	var user struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(result.Bytes(), &user); err != nil {
+		return "", fmt.Errorf("Could not parse twitch's answer: %s", err)
+	}
+	if user.Name == "" {
+		return "", fmt.Errorf("Twitch did not say who the token belongs to")
+	}
+	return user.Name, nil
+}
+
+// Save the tokens, or forget them after logging out
+func saveAuth(store CredentialStore, auth *TwitchAuth) {
+	var err error
+	if auth.Token() == "" {
+		err = store.Clear()
+	} else {
+		err = store.Save(authCredentials(auth))
+	}
+	if err != nil {
+		log.Print("Could not save the auth token: ", err)
+	}
+}
+
+// Directory holding twicciand's configuration
+func configDir() string {
+	return path.Join(os.Getenv("HOME"), ".config/twicciand")
+}
+
+// File holding the chat highlight rules
+func highlightsFile() string {
+	return path.Join(configDir(), "highlights.json")
+}
+
+// File holding the ignored users and chat filters
+func filtersFile() string {
+	return path.Join(configDir(), "filters.json")
+}
+
+// Directory holding twicciand's data, such as chat logs
+func dataDir() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return path.Join(dir, "twicciand")
+	}
+	return path.Join(os.Getenv("HOME"), ".local/share/twicciand")
+}
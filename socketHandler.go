@@ -7,12 +7,14 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 )
 
 type JsonRpc struct {
-	Api    string                 `json:"api"`
-	Name   string                 `json:"name"`
-	Params map[string]interface{} `json:"params"`
+	Api     string                 `json:"api"`
+	Name    string                 `json:"name"`
+	Account string                 `json:"account,omitempty"` // Account twitch calls are made as, the active one when empty
+	Params  map[string]interface{} `json:"params"`
 }
 
 type JsonRpcResult struct {
@@ -20,21 +22,33 @@ type JsonRpcResult struct {
 	Result interface{} `json:"result"`
 }
 
+type ParamsSubscribe struct {
+	Channels []string `json:"channels"`
+}
+
 type SocketReader struct {
 	Twitch        *TwitchApi
 	Local         *LocalApi
+	Chat          *TwitchChat
 	Listener      net.Listener
 	TwitchFuncmap map[string]func(*TwitchApi, []byte) bytes.Buffer
 	LocalFuncmap  map[string]func(*LocalApi, []byte) bytes.Buffer
+	subscriptions map[net.Conn]*ChatSubscriber
+	subLock       sync.Mutex
 }
 
 // Properly create a new socket reader
-func NewSocketReader(api *TwitchApi, chat *TwitchChat) *SocketReader {
+func NewSocketReader(settings *Settings, account *Account, chat *TwitchChat) *SocketReader {
+	config := settings.Config()
 	read := new(SocketReader)
-	read.Twitch = api
-	read.Local = NewLocalApi("", api.auth, chat)
+	read.Twitch = account.Api
+	read.Local = NewLocalApi(config.YoutubeDl.Path, account.Auth, chat)
+	read.Local.YDLArgs = config.YoutubeDl.Args
+	read.Local.settings = settings
+	read.Chat = chat
+	read.subscriptions = make(map[net.Conn]*ChatSubscriber)
 
-	ln, err := net.Listen("tcp", ":1921")
+	ln, err := net.Listen("tcp", config.Listen.Rpc)
 	if err != nil {
 		log.Panic("Could not open socketReader")
 	}
@@ -65,6 +79,27 @@ func NewSocketReader(api *TwitchApi, chat *TwitchChat) *SocketReader {
 	read.LocalFuncmap["getStreamDesc"] = (*LocalApi).getStreamDesc
 	read.LocalFuncmap["changeChat"] = (*LocalApi).changeChat
 	read.LocalFuncmap["isAuthenticated"] = (*LocalApi).isAuthenticated
+	read.LocalFuncmap["getChatQueue"] = (*LocalApi).getChatQueue
+	read.LocalFuncmap["chat.history"] = (*LocalApi).getChatHistory
+	read.LocalFuncmap["chat.search"] = (*LocalApi).searchChat
+	read.LocalFuncmap["chat.export"] = (*LocalApi).exportChat
+	read.LocalFuncmap["chat.highlights.get"] = (*LocalApi).getHighlights
+	read.LocalFuncmap["chat.highlights.set"] = (*LocalApi).setHighlights
+	read.LocalFuncmap["chat.ignore.add"] = (*LocalApi).ignoreUser
+	read.LocalFuncmap["chat.ignore.remove"] = (*LocalApi).unignoreUser
+	read.LocalFuncmap["chat.filters.get"] = (*LocalApi).getFilters
+	read.LocalFuncmap["chat.filters.set"] = (*LocalApi).setFilters
+	read.LocalFuncmap["chat.whisper"] = (*LocalApi).sendWhisper
+	read.LocalFuncmap["chat.whispers"] = (*LocalApi).getWhispers
+	read.LocalFuncmap["chat.status"] = (*LocalApi).getChatStatus
+	read.LocalFuncmap["auth.status"] = (*LocalApi).getAuthStatus
+	read.LocalFuncmap["auth.login"] = (*LocalApi).login
+	read.LocalFuncmap["auth.logout"] = (*LocalApi).logout
+	read.LocalFuncmap["auth.device"] = (*LocalApi).deviceLogin
+	read.LocalFuncmap["accounts.list"] = (*LocalApi).listAccounts
+	read.LocalFuncmap["accounts.switch"] = (*LocalApi).switchAccount
+	read.LocalFuncmap["chat.send"] = (*LocalApi).sendAs
+	read.LocalFuncmap["config.reload"] = (*LocalApi).reloadConfig
 
 	return read
 }
@@ -85,6 +120,9 @@ func (read *SocketReader) StartReader() {
 
 // Handle each incoming connection
 func (read *SocketReader) HandleConnection(conn net.Conn) {
+	// Stop streaming chat events once the client is gone
+	defer read.unsubscribe(conn)
+
 	// Read json data from the connection
 	var data bytes.Buffer
 	var total int
@@ -134,9 +172,29 @@ func (read *SocketReader) DispatchConnection(conn net.Conn, apiParams []byte) {
 
 	// Extract the json from the call parameters, and encode it as a string
 	command, _ := json.Marshal(call.Params)
+	logDebug("RPC call ", call.Api, " ", call.Name, " ", string(command))
+
+	// Twitch calls are made as the account they name
+	twitchApi := read.Twitch
+	if call.Api == "twitch" && read.Chat != nil && read.Chat.accounts != nil {
+		account := read.Chat.accounts.Get(call.Account)
+		if account == nil {
+			buf, _ := json.Marshal(&JsonRpcResult{Name: call.Name, Result: fmt.Sprintf("Unknown account: %s", call.Account)})
+			conn.Write(buf)
+			return
+		}
+		twitchApi = account.Api
+	}
 
 	// Dispatch function based on api
-	if call.Api == "local" {
+	if call.Api == "local" && call.Name == "chat.subscribe" {
+		// Streaming chat needs the connection itself rather than returning a single result
+		read.subscribe(conn, command)
+	} else if call.Api == "local" && call.Name == "chat.unsubscribe" {
+		read.unsubscribe(conn)
+		buf, _ := json.Marshal(&JsonRpcResult{Name: call.Name, Result: true})
+		conn.Write(buf)
+	} else if call.Api == "local" {
 		result := read.LocalFuncmap[call.Name](read.Local, command)
 		var genericResult interface{}
 		json.Unmarshal(result.Bytes(), &genericResult)
@@ -147,9 +205,14 @@ func (read *SocketReader) DispatchConnection(conn net.Conn, apiParams []byte) {
 
 		buf, _ := json.Marshal(resultJson)
 
+		conn.Write(buf)
+	} else if scope, ok := twitchMethodScopes[call.Name]; call.Api == "twitch" && ok && !twitchApi.auth.HasScope(scope) {
+		// Twitch would only answer with an empty result
+		log.Printf("Refusing twitch call %s, the auth token is missing the %s scope", call.Name, scope)
+		buf, _ := json.Marshal(&JsonRpcResult{Name: call.Name, Result: fmt.Sprintf("The auth token is missing the %s scope, log in again", scope)})
 		conn.Write(buf)
 	} else if call.Api == "twitch" {
-		result := read.TwitchFuncmap[call.Name](read.Twitch, command)
+		result := read.TwitchFuncmap[call.Name](twitchApi, command)
 		var genericResult interface{}
 		json.Unmarshal(result.Bytes(), &genericResult)
 		// fmt.Println("Stuff:", string(result.Bytes()))
@@ -164,3 +227,43 @@ func (read *SocketReader) DispatchConnection(conn net.Conn, apiParams []byte) {
 		conn.Write(buf)
 	}
 }
+
+// Stream chat events to an RPC client, as "chat.event" results
+func (read *SocketReader) subscribe(conn net.Conn, apiParams []byte) {
+	params := new(ParamsSubscribe)
+	err := json.Unmarshal(apiParams, params)
+	if err != nil {
+		log.Printf("Incorrect parameters passed to local call chat.subscribe: %s", err)
+	}
+
+	read.unsubscribe(conn)
+	sub := read.Chat.hub.Subscribe(params.Channels)
+	read.subLock.Lock()
+	read.subscriptions[conn] = sub
+	read.subLock.Unlock()
+
+	buf, _ := json.Marshal(&JsonRpcResult{Name: "chat.subscribe", Result: true})
+	conn.Write(buf)
+
+	go func() {
+		for ev := range sub.Events {
+			buf, _ := json.Marshal(&JsonRpcResult{Name: "chat.event", Result: ev})
+			if _, err := conn.Write(buf); err != nil {
+				read.unsubscribe(conn)
+				return
+			}
+		}
+	}()
+}
+
+// Stop streaming chat events to an RPC client
+func (read *SocketReader) unsubscribe(conn net.Conn) {
+	read.subLock.Lock()
+	sub, ok := read.subscriptions[conn]
+	delete(read.subscriptions, conn)
+	read.subLock.Unlock()
+
+	if ok {
+		read.Chat.hub.Unsubscribe(sub)
+	}
+}
@@ -52,44 +52,103 @@ type ParamsQueryFull struct {
 	Page  ParamsPage `json:"page_params"`
 }
 
+// Twitch's REST api, which the config can point at a local server for testing
+var twitchApiUrl = "https://api.twitch.tv"
+
+// Scopes the token needs for api methods acting on behalf of the user
+var twitchMethodScopes = map[string]string{
+	"getFollowedStreams": "user_read",
+	"getFollowedGames":   "user_read",
+}
+
 // This is the interface which describes the twitch API
 type TwitchApi struct {
-	auth *TwitchAuth
+	auth  Auth
+	cache *apiCache
 }
 
 // Create a constructor so a new API object cannot be created without an auth key
-func NewTwitchApi(auth *TwitchAuth) *TwitchApi {
+func NewTwitchApi(auth Auth) *TwitchApi {
 	api := new(TwitchApi)
 	api.auth = auth
+	api.cache = newApiCache()
+	// Answers made with the old token may not hold for the new one
+	auth.Watch(func(auth Auth) {
+		api.cache.Flush()
+	})
 
 	return api
 }
 
 // Take a URL and make a GET request to twitch's REST api
 func getApiUrl(url bytes.Buffer, api *TwitchApi) bytes.Buffer {
-	// Create a HTTP request
-	req, _ := http.NewRequest("GET", url.String(), nil)
-	req.Header.Set("Accept", "application/vnd.twitchtv.v3+json") // Request the v3 api
-	req.Header.Set("Client-ID", "mya9g4l7ucpsbwe2sjlj749d4hqzvvj")
-	req.Header.Set("Authorization", "OAuth "+api.auth.Password)
+	data, _ := fetchApiUrl(url.String(), api)
+	return data
+}
 
-	// Run that request
-	client := new(http.Client)
-	response, err := client.Do(req)
-	if err != nil {
-		log.Print("Error making GET request to url:", url.String())
+// Like getApiUrl, but reusing answers for cache.api_ttl. Only for calls whose
+// answer does not change with what the user does, such as following.
+func getCachedApiUrl(url bytes.Buffer, api *TwitchApi) bytes.Buffer {
+	var data bytes.Buffer
+	if body, ok := api.cache.Get(url.String()); ok {
+		data.Write(body)
+		return data
+	}
+	data, ok := fetchApiUrl(url.String(), api)
+	if ok {
+		api.cache.Put(url.String(), data.Bytes())
 	}
+	return data
+}
 
-	// Capture output in a bytes.Buffer
+// Make the request of getApiUrl, also telling whether twitch answered it
+func fetchApiUrl(url string, api *TwitchApi) (bytes.Buffer, bool) {
 	var data bytes.Buffer
+	response, token, err := api.get(url)
+
+	// An expired token is refreshed and the request made again
+	if err == nil && response.StatusCode == http.StatusUnauthorized && api.auth.CanRefresh() {
+		response.Body.Close()
+		if err = api.auth.Refresh(token); err != nil {
+			log.Print("Could not refresh the auth token: ", err)
+		} else {
+			response, _, err = api.get(url)
+		}
+	}
+
+	// Capture output in a bytes.Buffer
+	if err != nil {
+		log.Print("Error making GET request to url:", url)
+		return data, false
+	}
+	defer response.Body.Close()
 	_, err = data.ReadFrom(response.Body)
 
 	// Check if we read it correctly
 	if err != nil {
-		log.Print("Error receiving response from url:", url.String())
+		log.Print("Error receiving response from url:", url)
+		return data, false
 	}
+	return data, response.StatusCode == http.StatusOK
+}
 
-	return data
+// Make an authorized GET request, also returning the token it was made with
+func (api *TwitchApi) get(url string) (*http.Response, string, error) {
+	token := api.auth.Token()
+
+	// Create a HTTP request
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, token, err
+	}
+	req.Header.Set("Accept", "application/vnd.twitchtv.v3+json") // Request the v3 api
+	req.Header.Set("Client-ID", twitchClientId)
+	req.Header.Set("Authorization", "OAuth "+token)
+
+	// Run that request
+	client := new(http.Client)
+	response, err := client.Do(req)
+	return response, token, err
 }
 
 // Returns a channel object, takes a ParamsQuery
@@ -102,10 +161,10 @@ func (api *TwitchApi) getChannel(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/channels/")
+	url.WriteString(twitchApiUrl + "/kraken/channels/")
 	url.WriteString(params.Query)
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) getChannelVideos(apiParams []byte) bytes.Buffer {
@@ -118,14 +177,14 @@ func (api *TwitchApi) getChannelVideos(apiParams []byte) bytes.Buffer {
 	var url bytes.Buffer
 
 	// Compose the url for the request
-	url.WriteString("https://api.twitch.tv/kraken/channels/")
+	url.WriteString(twitchApiUrl + "/kraken/channels/")
 	url.WriteString(params.Query)
 	url.WriteString("/videos?limit=")
 	url.WriteString(strconv.Itoa(params.Page.Limit))
 	url.WriteString("&offset=")
 	url.WriteString(strconv.Itoa(params.Page.Offset))
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) getChannelFollows(apiParams []byte) bytes.Buffer {
@@ -137,7 +196,7 @@ func (api *TwitchApi) getChannelFollows(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/channels/")
+	url.WriteString(twitchApiUrl + "/kraken/channels/")
 	url.WriteString(params.Query)
 	url.WriteString("/follows?limit=")
 	url.WriteString(strconv.Itoa(30)) // params.Page.Limit
@@ -156,11 +215,11 @@ func (api *TwitchApi) getChannelTeams(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/channels/")
+	url.WriteString(twitchApiUrl + "/kraken/channels/")
 	url.WriteString(params.Query)
 	url.WriteString("/teams")
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) getChannelBadges(apiParams []byte) bytes.Buffer {
@@ -172,19 +231,19 @@ func (api *TwitchApi) getChannelBadges(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/chat/")
+	url.WriteString(twitchApiUrl + "/kraken/chat/")
 	url.WriteString(params.Query)
 	url.WriteString("/badges")
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) getEmotes(apiParams []byte) bytes.Buffer {
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/chat/emoticons")
+	url.WriteString(twitchApiUrl + "/kraken/chat/emoticons")
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) getUserObject(apiParams []byte) bytes.Buffer {
@@ -196,10 +255,10 @@ func (api *TwitchApi) getUserObject(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/users/")
+	url.WriteString(twitchApiUrl + "/kraken/users/")
 	url.WriteString(params.Query)
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) getUser(apiParams []byte) bytes.Buffer {
@@ -210,7 +269,7 @@ func (api *TwitchApi) getUser(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/user")
+	url.WriteString(twitchApiUrl + "/kraken/user")
 
 	return getApiUrl(url, api)
 }
@@ -224,7 +283,7 @@ func (api *TwitchApi) getUserFollows(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/users/")
+	url.WriteString(twitchApiUrl + "/kraken/users/")
 	url.WriteString(params.Query)
 	url.WriteString("/follows/channels?limit=")
 	url.WriteString(strconv.Itoa(params.Page.Limit))
@@ -243,7 +302,7 @@ func (api *TwitchApi) isUserFollowing(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/users/")
+	url.WriteString(twitchApiUrl + "/kraken/users/")
 	url.WriteString(params.Query)
 	url.WriteString("/follows/channels/")
 	url.WriteString(params.Target)
@@ -260,12 +319,12 @@ func (api *TwitchApi) getGames(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/games/top?limit=")
+	url.WriteString(twitchApiUrl + "/kraken/games/top?limit=")
 	url.WriteString(strconv.Itoa(30)) // params.Page.Limit
 	url.WriteString("&offset=")
 	url.WriteString(strconv.Itoa(params.Offset))
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) searchChannels(apiParams []byte) bytes.Buffer {
@@ -277,14 +336,14 @@ func (api *TwitchApi) searchChannels(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/search/channels?q=")
+	url.WriteString(twitchApiUrl + "/kraken/search/channels?q=")
 	url.WriteString(params.Query)
 	url.WriteString("&limit=")
 	url.WriteString(strconv.Itoa(params.Page.Limit))
 	url.WriteString("&offset=")
 	url.WriteString(strconv.Itoa(params.Page.Offset))
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) searchStreams(apiParams []byte) bytes.Buffer {
@@ -296,14 +355,14 @@ func (api *TwitchApi) searchStreams(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/search/streams?q=")
+	url.WriteString(twitchApiUrl + "/kraken/search/streams?q=")
 	url.WriteString(params.Query)
 	url.WriteString("&limit=")
 	url.WriteString(strconv.Itoa(30)) // params.Page.Limit
 	url.WriteString("&offset=")
 	url.WriteString(strconv.Itoa(params.Page.Offset))
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) searchGames(apiParams []byte) bytes.Buffer {
@@ -316,13 +375,13 @@ func (api *TwitchApi) searchGames(apiParams []byte) bytes.Buffer {
 	var url bytes.Buffer
 
 	//url.WriteString("https://api.twitch.tv/kraken/search/games?q=")
-	url.WriteString("https://api.twitch.tv/kraken/streams?game=")
+	url.WriteString(twitchApiUrl + "/kraken/streams?game=")
 	url.WriteString(params.Query)
 	url.WriteString("&limit=")
 	url.WriteString(strconv.Itoa(30)) // params.Page.Limit
 	url.WriteString("&offset=")
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) getStream(apiParams []byte) bytes.Buffer {
@@ -334,7 +393,7 @@ func (api *TwitchApi) getStream(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/streams/")
+	url.WriteString(twitchApiUrl + "/kraken/streams/")
 	url.WriteString(params.Query)
 
 	return getApiUrl(url, api)
@@ -349,12 +408,12 @@ func (api *TwitchApi) getFeaturedStreams(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/streams/featured?limit=")
+	url.WriteString(twitchApiUrl + "/kraken/streams/featured?limit=")
 	url.WriteString(strconv.Itoa(params.Limit))
 	url.WriteString("&offset=")
 	url.WriteString(strconv.Itoa(params.Offset))
 
-	return getApiUrl(url, api)
+	return getCachedApiUrl(url, api)
 }
 
 func (api *TwitchApi) getFollowedStreams(apiParams []byte) bytes.Buffer {
@@ -366,7 +425,7 @@ func (api *TwitchApi) getFollowedStreams(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/kraken/streams/followed?limit=")
+	url.WriteString(twitchApiUrl + "/kraken/streams/followed?limit=")
 	url.WriteString(strconv.Itoa(params.Limit))
 	url.WriteString("&offset=")
 	url.WriteString(strconv.Itoa(params.Offset))
@@ -382,7 +441,7 @@ func (api *TwitchApi) getFollowedGames(apiParams []byte) bytes.Buffer {
 	}
 
 	var usr bytes.Buffer
-	usr.WriteString("https://api.twitch.tv/kraken/user")
+	usr.WriteString(twitchApiUrl + "/kraken/user")
 	var username = getApiUrl(usr, api)
 	name := new(ParamsName)
 	err = json.Unmarshal(username.Bytes(), name)
@@ -392,7 +451,7 @@ func (api *TwitchApi) getFollowedGames(apiParams []byte) bytes.Buffer {
 
 	var url bytes.Buffer
 
-	url.WriteString("https://api.twitch.tv/api/users/")
+	url.WriteString(twitchApiUrl + "/api/users/")
 	url.WriteString(name.Query)
 	url.WriteString("/follows/games/live")
 
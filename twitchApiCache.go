@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long twitch's answers are reused for unless cache.api_ttl says otherwise,
+// which is not at all: a cached answer can hide a change the user just made
+const apiCacheTTL time.Duration = 0
+
+// Answers to recent api requests. They depend on the token they were made
+// with, so the cache is flushed whenever the token changes.
+type apiCache struct {
+	entries map[string]apiCacheEntry
+	ttl     time.Duration
+	lock    sync.Mutex
+}
+
+type apiCacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+func newApiCache() *apiCache {
+	cache := new(apiCache)
+	cache.entries = make(map[string]apiCacheEntry)
+	cache.ttl = apiCacheTTL
+	return cache
+}
+
+// Change how long answers are reused, 0 stops caching them
+func (cache *apiCache) SetTTL(ttl time.Duration) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.ttl = ttl
+}
+
+// The answer to a request made less than the cache's ttl ago
+func (cache *apiCache) Get(url string) ([]byte, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[url]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.body, true
+}
+
+// Remember an answer, dropping the ones which expired
+func (cache *apiCache) Put(url string, body []byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	for key, entry := range cache.entries {
+		if now.After(entry.expires) {
+			delete(cache.entries, key)
+		}
+	}
+	cache.entries[url] = apiCacheEntry{body: append([]byte(nil), body...), expires: now.Add(cache.ttl)}
+}
+
+// Forget every answer
+func (cache *apiCache) Flush() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.entries = make(map[string]apiCacheEntry)
+}